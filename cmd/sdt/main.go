@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -65,11 +67,15 @@ func init() {
 var useColor bool
 var format string
 var verbose bool
+var sortKeys bool
 
 var renderExample = `sdt render doc.yaml <params.yaml
 sdt render doc.yaml name: Alice, param2: 123
 sdt render doc.yaml <params.yaml name: override`
 
+var testExample = `sdt test doc.yaml
+sdt test templates/*.sdt.yaml`
+
 // highlight a block of data with the given lexer.
 func highlight(lexer string, data []byte) ([]byte, error) {
 	sb := &strings.Builder{}
@@ -125,9 +131,13 @@ func printWarnings(warnings []sdt.ContextError) {
 
 func exitErr(code int, msg string, err error) {
 	if format != "default" {
-		printResult([]interface{}{map[string]interface{}{
+		result := map[string]interface{}{
 			"message": err.Error(),
-		}})
+		}
+		if code := sdt.ErrorCode(err); code != "" {
+			result["code"] = code
+		}
+		printResult([]interface{}{result})
 		os.Exit(code)
 	}
 
@@ -145,12 +155,14 @@ func exit(code int, msg string, warnings []sdt.ContextError, errs []sdt.ContextE
 		for _, x := range [][]sdt.ContextError{warnings, errs} {
 			for _, y := range x {
 				combined = append(combined, map[string]interface{}{
-					"path":    y.Path(),
-					"offset":  y.Offset(),
-					"line":    y.Line(),
-					"column":  y.Column(),
-					"length":  y.Length(),
-					"message": y.Message(),
+					"code":     y.Code(),
+					"severity": y.Severity(),
+					"path":     y.Path(),
+					"offset":   y.Offset(),
+					"line":     y.Line(),
+					"column":   y.Column(),
+					"length":   y.Length(),
+					"message":  y.Message(),
 					// "source":  y.Source(),
 				})
 			}
@@ -161,7 +173,7 @@ func exit(code int, msg string, warnings []sdt.ContextError, errs []sdt.ContextE
 
 	printWarnings(warnings)
 	if len(errs) > 0 {
-		fmt.Fprintln(os.Stderr, "❌ Error while validating template:")
+		fmt.Fprintln(os.Stderr, msg)
 		for i, err := range errs {
 			fmt.Fprintf(os.Stderr, "%v\n",
 				colorMarkerRegex.ReplaceAllString(err.Error(), colorize(31, "$0")))
@@ -184,7 +196,7 @@ func mustLoad(filename string) *sdt.Document {
 	warnings, errs := doc.ValidateTemplate()
 
 	if len(errs) > 0 {
-		exit(1, "❌ Error while validating template", warnings, errs)
+		exit(1, "❌ Error while validating template:", warnings, errs)
 	}
 
 	printWarnings(warnings)
@@ -192,6 +204,127 @@ func mustLoad(filename string) *sdt.Document {
 	return doc
 }
 
+// getInput loads params from stdin as JSON/YAML and merges in any CLI
+// shorthand arguments. Unlike `shorthand.GetInput`, the stdin source is kept
+// so that validation errors can point to bad values.
+func getInput(args []string) (*sdt.Params, error) {
+	params := &sdt.Params{
+		Filename: "args",
+		Values:   map[string]interface{}{},
+	}
+
+	stat, _ := os.Stdin.Stat()
+	if (stat.Mode() & os.ModeCharDevice) == 0 {
+		d, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, err
+		}
+
+		params, err = sdt.ParseParams("stdin", d)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(args) > 0 {
+		parsed, err := shorthand.ParseAndBuild("args", strings.Join(args, " "))
+		if err != nil {
+			return nil, err
+		}
+
+		// Round-trip to remove custom shorthand list types. Numbers are
+		// decoded as `json.Number` so that large integers keep their
+		// precision, then converted using the input schema when rendering.
+		enc, err := json.Marshal(parsed)
+		if err != nil {
+			return nil, err
+		}
+		values := map[string]interface{}{}
+		dec := json.NewDecoder(bytes.NewReader(enc))
+		dec.UseNumber()
+		if err := dec.Decode(&values); err != nil {
+			return nil, err
+		}
+
+		// Values from args are validated against their own source, rather
+		// than being reported as coming from stdin.
+		params.Merge(&sdt.Params{Filename: "args", Values: values})
+	}
+
+	return params, nil
+}
+
+// runTests runs all test cases for the given document files, printing the
+// results. Returns whether all tests passed.
+func runTests(filenames []string) bool {
+	passed := 0
+	failed := 0
+	combined := []interface{}{}
+
+	for _, filename := range filenames {
+		doc, err := sdt.NewFromFile(filename)
+		if err == nil {
+			err = doc.LoadTests()
+		}
+		if err != nil {
+			exitErr(1, "❌ Unable to load "+filename, err)
+		}
+
+		if len(doc.Tests) == 0 && format == "default" {
+			printColor(33, "warning", fmt.Errorf("%s: no tests found", filename))
+		}
+
+		for i, result := range doc.RunTests() {
+			name := result.Name
+			if name == "" {
+				name = fmt.Sprintf("%d", i)
+			}
+
+			if result.Passed() {
+				passed++
+			} else {
+				failed++
+			}
+
+			if format != "default" {
+				combined = append(combined, map[string]interface{}{
+					"filename": filename,
+					"name":     name,
+					"passed":   result.Passed(),
+					"failures": result.Failures,
+					"diff":     result.Diff,
+				})
+				continue
+			}
+
+			if result.Passed() {
+				if verbose {
+					fmt.Fprintf(os.Stderr, "%s %s: %s\n", colorize(32, "PASS"), filename, name)
+				}
+				continue
+			}
+
+			fmt.Fprintf(os.Stderr, "%s %s: %s\n", colorize(31, "FAIL"), filename, name)
+			for _, failure := range result.Failures {
+				fmt.Fprintf(os.Stderr, "    %s\n", strings.ReplaceAll(failure, "\n", "\n    "))
+			}
+			for _, d := range result.Diff {
+				fmt.Fprintf(os.Stderr, "    %s\n", colorize(33, d))
+			}
+		}
+	}
+
+	if format != "default" {
+		printResult(combined)
+	} else if failed > 0 {
+		fmt.Fprintf(os.Stderr, "❌ %d passed, %d failed\n", passed, failed)
+	} else {
+		fmt.Fprintf(os.Stderr, "✅ %d passed\n", passed)
+	}
+
+	return failed == 0
+}
+
 func main() {
 	if fileInfo, _ := os.Stdout.Stat(); (fileInfo.Mode() & os.ModeCharDevice) != 0 {
 		if os.Getenv("NO_COLOR") == "" {
@@ -201,7 +334,7 @@ func main() {
 
 	root := cobra.Command{
 		Long:    "Structured Data Templates",
-		Example: "sdt validate doc.yaml\nsdt render doc.yaml <params.yaml some: value, other: 123",
+		Example: "sdt validate doc.yaml\nsdt render doc.yaml <params.yaml some: value, other: 123\nsdt test doc.yaml",
 	}
 
 	root.PersistentFlags().StringVarP(&format, "output", "o", "default", "Output format [json, yaml, shorthand]")
@@ -240,20 +373,12 @@ func main() {
 		Run: func(cmd *cobra.Command, args []string) {
 			doc := mustLoad(args[0])
 
-			params, err := shorthand.GetInput(args[1:])
+			input, err := getInput(args[1:])
 			if err != nil {
 				exitErr(1, "❌ Error getting input\n%v", err)
 			}
-			if params == nil {
-				params = map[string]interface{}{}
-			} else {
-				// Temporary fix: round-trip to remove custom shorthand list types.
-				enc, err := json.Marshal(params)
-				if err != nil {
-					panic(err)
-				}
-				json.Unmarshal(enc, &params)
-			}
+
+			params := input.Values
 
 			if verbose {
 				fmt.Fprintln(os.Stderr, "Input:")
@@ -261,23 +386,30 @@ func main() {
 			}
 
 			// Validate params from template input schema
-			if err := doc.ValidateInput(params); err != nil {
-				exitErr(1, "❌ Error while validating input params:", err)
+			if errs := doc.ValidateParams(input); len(errs) > 0 {
+				exit(1, "❌ Error while validating input params:", nil, errs)
 			}
 
-			// Render the output
-			rendered, errs := doc.Render(params)
+			// Render the output. Shorthand always sorts keys, so there is no need
+			// to keep the template's key order for it.
+			sources := &sdt.SourceMap{}
+			opts := &sdt.RenderOptions{
+				PreserveOrder: !sortKeys && format != "shorthand",
+				SourceMap:     sources,
+			}
+			rendered, errs := doc.RenderContext(context.Background(), params, opts)
 			if len(errs) > 0 {
 				exit(1, "❌ Error while rendering template:", nil, errs)
 			}
 
 			// Confirm that the output conforms to the schema now that it's rendered.
-			if err := doc.ValidateOutput(rendered); err != nil {
+			// Errors point to the template location which produced each bad value.
+			if errs := doc.ValidateOutputSources(rendered, sources); len(errs) > 0 {
 				if verbose {
 					fmt.Fprintln(os.Stderr, "Rendered result:")
 					printResult(rendered)
 				}
-				exitErr(1, "❌ Error validating rendered output:", err)
+				exit(1, "❌ Error validating rendered output:", nil, errs)
 			}
 
 			if verbose {
@@ -287,9 +419,24 @@ func main() {
 		},
 	}
 
+	render.Flags().BoolVar(&sortKeys, "sort-keys", false, "Sort object keys instead of keeping the template order")
+
+	test := &cobra.Command{
+		Use:     "test FILENAME...",
+		Short:   "Run test cases embedded in or next to structured data templates",
+		Example: testExample,
+		Args:    cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if !runTests(args) {
+				os.Exit(1)
+			}
+		},
+	}
+
 	root.AddCommand(example)
 	root.AddCommand(validate)
 	root.AddCommand(render)
+	root.AddCommand(test)
 
 	root.Execute()
 }
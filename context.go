@@ -14,19 +14,39 @@ func refToPath(ref string) string {
 	// Convert schema $ref to JSON/YAML Path.
 	// #/foo/bar/0/baz => $.'foo'.'bar'[0].'baz'
 	p := "$"
-	for _, item := range strings.Split(strings.Trim(ref, "/"), "/") {
+	ref = strings.Trim(ref, "/")
+	if ref == "" {
+		// The root of the document.
+		return p
+	}
+	for _, item := range strings.Split(ref, "/") {
 		if _, err := strconv.Atoi(item); err == nil {
 			p += "[" + item + "]"
 			continue
 		}
-		p += ".'" + item + "'"
+		item = strings.NewReplacer("~1", "/", "~0", "~").Replace(item)
+		p += ".'" + pathQuoteReplacer.Replace(item) + "'"
 	}
 	return p
 }
 
+// pathQuoteReplacer escapes a key for use within a quoted YAML Path selector.
+var pathQuoteReplacer = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// ContextError is an error or warning at a specific location within a
+// document. Use `errors.Is` and `errors.As` to check its kind, e.g.
+// `errors.Is(err, sdt.ErrTypeMismatch)`.
 type ContextError interface {
 	Error() string
 	Message() string
+
+	// Code is the stable code for the kind of error, e.g. `type_mismatch`.
+	// It is empty if the kind is not known.
+	Code() string
+
+	// Severity is whether this is an error or a warning.
+	Severity() Severity
+
 	Path() string
 	Offset() int
 	Line() int
@@ -36,23 +56,40 @@ type ContextError interface {
 }
 
 type contextError struct {
-	err    error
-	path   string
-	offset int
-	line   int
-	column int
-	length int
-	source string
+	err      error
+	severity Severity
+	path     string
+	offset   int
+	line     int
+	column   int
+	length   int
+	source   string
 }
 
 func (e *contextError) Error() string {
 	return fmt.Sprintf("%s: %s\n%s", e.path, e.err, e.source)
 }
 
+// Unwrap returns the underlying error, e.g. for use with `errors.Is`.
+func (e *contextError) Unwrap() error {
+	return e.err
+}
+
 func (e *contextError) Message() string {
 	return e.err.Error()
 }
 
+func (e *contextError) Code() string {
+	return ErrorCode(e.err)
+}
+
+func (e *contextError) Severity() Severity {
+	if e.severity == "" {
+		return SeverityError
+	}
+	return e.severity
+}
+
 func (e *contextError) Path() string {
 	return e.path
 }
@@ -79,7 +116,17 @@ func (e *contextError) Source() string {
 
 type contextMeta struct {
 	Errors             []ContextError
+	Warnings           []ContextError
 	TemplateComplexity int
+
+	// Limits enforces cancellation and render options, if set.
+	Limits *renderLimits
+
+	// Order records the key order of rendered objects, if enabled.
+	Order *keyOrder
+
+	// Sources records the template location of rendered values, if enabled.
+	Sources *sourceRecorder
 }
 
 type context struct {
@@ -87,14 +134,34 @@ type context struct {
 	Path     string
 	Meta     *contextMeta
 	AST      *ast.File
+
+	// Doc is the document being processed, used to look up definitions.
+	Doc *Document
+
+	// Refs is the stack of definitions currently being processed, used to
+	// handle recursive definitions.
+	Refs []string
+
+	// Includes is the stack of files currently being processed, used to
+	// detect include cycles.
+	Includes []string
+
+	// Program holds precompiled strings when rendering a compiled document.
+	Program *Program
+
+	// Vars are the local variables bound by operators like `$for` while
+	// validating, used to check whether required properties may be missing.
+	Vars *missingScope
 }
 
-func newContext(filename string, astFile *ast.File, path ...string) *context {
+func newContext(doc *Document, path ...string) *context {
 	return &context{
-		Filename: filename,
+		Filename: doc.Filename,
 		Path:     "/" + strings.Join(path, "/"),
 		Meta:     &contextMeta{},
-		AST:      astFile,
+		AST:      doc.ast,
+		Doc:      doc,
+		Includes: []string{stripFragment(doc.Filename)},
 	}
 }
 
@@ -104,7 +171,70 @@ func (c *context) WithPath(path interface{}) *context {
 		Path:     strings.TrimRight(c.Path, "/") + "/" + fmt.Sprintf("%v", path),
 		Meta:     c.Meta,
 		AST:      c.AST,
+		Doc:      c.Doc,
+		Refs:     c.Refs,
+		Includes: c.Includes,
+		Program:  c.Program,
+		Vars:     c.Vars,
+	}
+}
+
+// WithRef returns a new context for processing the given definition. The
+// path is reset to point at the definition's template within the document.
+func (c *context) WithRef(def *definition) *context {
+	refs := make([]string, len(c.Refs), len(c.Refs)+1)
+	copy(refs, c.Refs)
+	return &context{
+		Filename: c.Filename,
+		Path:     def.Path,
+		Meta:     c.Meta,
+		AST:      c.AST,
+		Doc:      c.Doc,
+		Refs:     append(refs, def.Name),
+		Includes: c.Includes,
+		Program:  c.Program,
+		Vars:     c.Vars,
+	}
+}
+
+// WithInclude returns a new context for processing the template of an
+// included document. Errors are reported within the included document.
+func (c *context) WithInclude(doc *Document) *context {
+	includes := make([]string, len(c.Includes), len(c.Includes)+1)
+	copy(includes, c.Includes)
+	return &context{
+		Filename: doc.Filename,
+		Path:     "/template",
+		Meta:     c.Meta,
+		AST:      doc.ast,
+		Doc:      doc,
+		Includes: append(includes, stripFragment(doc.Filename)),
+		Program:  c.Program,
+		Vars:     c.Vars,
+	}
+}
+
+// IncludeCycle returns the include chain if including the given document
+// would result in a cycle, otherwise nil.
+func (c *context) IncludeCycle(doc *Document) []string {
+	filename := stripFragment(doc.Filename)
+	for i, include := range c.Includes {
+		if include == filename {
+			cycle := append([]string{}, c.Includes[i:]...)
+			return append(cycle, filename)
+		}
 	}
+	return nil
+}
+
+// HasRef returns whether the named definition is already being processed.
+func (c *context) HasRef(name string) bool {
+	for _, ref := range c.Refs {
+		if ref == name {
+			return true
+		}
+	}
+	return false
 }
 
 // FullPath returns the full path to the context, including the filename if
@@ -128,6 +258,21 @@ func (c *context) AddError(value error) interface{} {
 // AddErrorOffset adds an error into the rendering context at the current path
 // plus an additional offset. As a convenience it returns nil.
 func (c *context) AddErrorOffset(value error, offset uint16, length uint8) interface{} {
+	c.Meta.Errors = append(c.Meta.Errors, c.newError(value, offset, length))
+	return nil
+}
+
+// AddWarning adds a warning into the context at the current path. Warnings
+// describe likely mistakes which do not prevent the template from rendering.
+func (c *context) AddWarning(value error) {
+	warning := c.newError(value, 0, 0)
+	warning.severity = SeverityWarning
+	c.Meta.Warnings = append(c.Meta.Warnings, warning)
+}
+
+// newError creates a new error at the current path plus an additional offset,
+// including the source location if the AST is available.
+func (c *context) newError(value error, offset uint16, length uint8) *contextError {
 	source := ""
 	posOffset := 0
 	line := 0
@@ -165,7 +310,7 @@ func (c *context) AddErrorOffset(value error, offset uint16, length uint8) inter
 		}
 	}
 
-	c.Meta.Errors = append(c.Meta.Errors, &contextError{
+	return &contextError{
 		err:    value,
 		path:   c.FullPath(),
 		offset: posOffset,
@@ -173,6 +318,5 @@ func (c *context) AddErrorOffset(value error, offset uint16, length uint8) inter
 		column: col,
 		length: int(length),
 		source: source,
-	})
-	return nil
+	}
 }
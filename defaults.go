@@ -2,29 +2,131 @@ package sdt
 
 import (
 	"encoding/json"
+	"math"
+	"math/big"
+	"strconv"
 
 	jsonschema "github.com/santhosh-tekuri/jsonschema/v5"
 )
 
 // convertNumberIfNeeded will convert `json.Number` objects into either
-// an int64 or float64 depending on what the schema calls for.
+// an int64 or float64 depending on what the schema calls for. Floats with no
+// fractional part are converted to int64 for integer schemas. Numbers which
+// can't be represented exactly are left as `json.Number` so that no precision
+// is lost, e.g. for large IDs.
 func convertNumberIfNeeded(v interface{}, s *jsonschema.Schema) interface{} {
 	switch d := v.(type) {
 	case json.Number:
-		if hasType(s, "integer") {
-			di, _ := d.Int64()
+		if di, err := d.Int64(); err == nil {
 			return di
-		} else {
-			df, _ := d.Float64()
-			return df
+		}
+		df, err := d.Float64()
+		if err != nil {
+			return d
+		}
+		if hasType(s, "integer") {
+			if di, ok := floatToInt64(df); ok {
+				return di
+			}
+			return d
+		}
+		if !isExactFloat(d.String(), df) {
+			return d
+		}
+		return df
+	case float64:
+		if hasType(s, "integer") {
+			if di, ok := floatToInt64(d); ok {
+				return di
+			}
 		}
 	}
 	return v
 }
 
+// floatToInt64 converts a float into an int64 if it has no fractional part
+// and is within range.
+func floatToInt64(f float64) (int64, bool) {
+	if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// isExactFloat returns whether the float, when formatted, has the same value
+// as the decimal number it was parsed from.
+func isExactFloat(decimal string, f float64) bool {
+	expected, ok := new(big.Rat).SetString(decimal)
+	if !ok {
+		return false
+	}
+	actual, ok := new(big.Rat).SetString(strconv.FormatFloat(f, 'g', -1, 64))
+	if !ok {
+		return false
+	}
+	return expected.Cmp(actual) == 0
+}
+
+// coerceNumbers converts any numbers within the value into the Go types
+// described by the schema, e.g. `json.Number` values from a decoder using
+// `UseNumber`. Maps and slices are modified in-place, so callers must pass a
+// copy of any values they do not own.
+func coerceNumbers(s *jsonschema.Schema, v interface{}) interface{} {
+	if s == nil {
+		s = &jsonschema.Schema{}
+	}
+	for s.Ref != nil {
+		s = s.Ref
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, item := range t {
+			t[k] = coerceNumbers(getPropertySchema(s, k), item)
+		}
+	case []interface{}:
+		for i, item := range t {
+			t[i] = coerceNumbers(getItems(s), item)
+		}
+	default:
+		return convertNumberIfNeeded(v, s)
+	}
+
+	return v
+}
+
+// copyValue returns a deep copy of any maps and slices within the value so
+// that it can be safely modified.
+func copyValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return copyMap(t)
+	case []interface{}:
+		tmp := make([]interface{}, len(t))
+		for i, item := range t {
+			tmp[i] = copyValue(item)
+		}
+		return tmp
+	}
+	return v
+}
+
+// copyMap returns a deep copy of the map.
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	tmp := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		tmp[k] = copyValue(v)
+	}
+	return tmp
+}
+
 // setDefaults takes user-provided input and traverses it along with the input
 // schema to determine if unset values exist which have a default that should
-// be set, then sets them. Params are modified in-place.
+// be set, then sets them. Params are modified in-place, so callers must pass
+// a copy of any params they do not own.
 func setDefaults(s *jsonschema.Schema, params map[string]interface{}) {
 	for s.Ref != nil {
 		s = s.Ref
@@ -39,7 +141,8 @@ func setDefaults(s *jsonschema.Schema, params map[string]interface{}) {
 				// Handle arbitrary JSON numbers by converting to the closest Go
 				// type so that expressions work as expected. E.g. a json.Number can't
 				// be added to an int, so this fixes that.
-				params[k] = convertNumberIfNeeded(v.Default, v)
+				// Copy so the schema's default is never modified.
+				params[k] = convertNumberIfNeeded(copyValue(v.Default), v)
 			}
 		}
 
@@ -1,9 +1,13 @@
 package sdt
 
 import (
+	gocontext "context"
 	"fmt"
 	"io/ioutil"
 	"path"
+	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/goccy/go-yaml/ast"
 	"github.com/goccy/go-yaml/parser"
@@ -22,15 +26,87 @@ type Schemas struct {
 
 // Document is a combination of input/output schemas and a template to
 // render out a data structure. Context data that is described by the schema
-// is passed as input when rendering.
+// is passed as input when rendering. Optional test cases can be embedded to
+// check the rendered output for a set of inputs.
+//
+// Once loaded, a document is safe for concurrent use by multiple goroutines
+// for validating and rendering, as long as its exported fields are not
+// modified. Params passed in are never modified.
 type Document struct {
 	Filename string      `json:"-" yaml:"-"`
 	Schemas  *Schemas    `json:"schemas" yaml:"schemas"`
 	Template interface{} `json:"template" yaml:"template"`
+	Tests    []Test      `json:"tests,omitempty" yaml:"tests,omitempty"`
+
+	// Definitions are reusable template fragments which can be referenced
+	// from within the template via `$ref: "#/definitions/name"` or called with
+	// arguments via `$call: name`. A definition can declare its arguments by
+	// using an object with `$input` (a schema) and `$template` properties.
+	Definitions map[string]interface{} `json:"definitions,omitempty" yaml:"definitions,omitempty"`
+
+	// Constants are static values which are always available to expressions
+	// via the reserved `const` name, e.g. `${const.endpoints.us}`. Unlike
+	// input defaults, they cannot be overridden by the input params.
+	Constants map[string]interface{} `json:"constants,omitempty" yaml:"constants,omitempty"`
+
+	ast               *ast.File
+	keyOrder          map[string][]string
+	inputSchema       *jsonschema.Schema
+	outputSchema      *jsonschema.Schema
+	definitionSchemas map[string]*jsonschema.Schema
+	includes          map[string]*Document
+
+	// schemasMu guards the lazy compilation of schemas.
+	schemasMu sync.Mutex
+
+	// includesMu guards the cache of included documents.
+	includesMu sync.Mutex
+}
+
+// constantsName is the reserved params name under which constants are made
+// available to expressions.
+const constantsName = "const"
 
-	ast          *ast.File
-	inputSchema  *jsonschema.Schema
-	outputSchema *jsonschema.Schema
+// stripFragment removes any `#...` fragment from a filename.
+func stripFragment(filename string) string {
+	return strings.SplitN(filename, "#", 2)[0]
+}
+
+// definition describes a reusable template fragment from the document.
+type definition struct {
+	// Name of the definition.
+	Name string
+
+	// Path to the definition's template within the document.
+	Path string
+
+	// Template to render.
+	Template interface{}
+
+	// Schema describes the arguments, if any were declared via `$input`.
+	Schema *jsonschema.Schema
+}
+
+// getDefinition returns the named definition, if it exists.
+func (doc *Document) getDefinition(name string) (*definition, bool) {
+	t, ok := doc.Definitions[name]
+	if !ok {
+		return nil, false
+	}
+
+	def := &definition{
+		Name:     name,
+		Path:     "/definitions/" + name,
+		Template: t,
+	}
+
+	if m, ok := t.(map[string]interface{}); ok && m["$template"] != nil {
+		def.Path += "/$template"
+		def.Template = m["$template"]
+		def.Schema = doc.definitionSchemas[name]
+	}
+
+	return def, true
 }
 
 // New creates a new document.
@@ -62,29 +138,64 @@ func NewFromBytes(filename string, data []byte) (*Document, error) {
 	return doc, nil
 }
 
+// loadInclude loads a document referenced via `$include`. Relative filenames
+// are resolved from the directory containing this document. Loaded documents
+// are cached so each file is only read once.
+func (doc *Document) loadInclude(filename string) (*Document, error) {
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(filepath.Dir(stripFragment(doc.Filename)), filename)
+	}
+
+	doc.includesMu.Lock()
+	defer doc.includesMu.Unlock()
+
+	if included, ok := doc.includes[filename]; ok {
+		return included, nil
+	}
+
+	included, err := NewFromFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := included.LoadSchemas(); err != nil {
+		return nil, err
+	}
+
+	if doc.includes == nil {
+		doc.includes = map[string]*Document{}
+	}
+	doc.includes[filename] = included
+
+	return included, nil
+}
+
 func (doc *Document) LoadAST(data []byte) error {
 	astFile, err := parser.ParseBytes(data, 0)
 	if err != nil {
 		return err
 	}
 	doc.ast = astFile
+	doc.keyOrder = loadKeyOrder(astFile)
+
 	return nil
 }
 
+// LoadSchemas compiles the document's input, output, and definition argument
+// schemas. It is called automatically as needed and only compiles each schema
+// once, so it is safe to call multiple times and from multiple goroutines.
 func (doc *Document) LoadSchemas() error {
 	if doc.Schemas == nil {
 		return nil
 	}
 
+	doc.schemasMu.Lock()
+	defer doc.schemasMu.Unlock()
+
 	if doc.inputSchema == nil && doc.Schemas.Input != nil {
-		doc.Schemas.Input["type"] = "object"
-		if doc.Schemas.Input["additionalProperties"] == nil {
-			// Input should be strict!
-			doc.Schemas.Input["additionalProperties"] = false
-		}
-		s, err := compileSchema(path.Join(doc.Filename, "schemas", "input"), doc.Schemas.Dialect, doc.Schemas.Input)
+		s, err := compileSchema(path.Join(doc.Filename, "schemas", "input"), doc.Schemas.Dialect, strictObject(doc.Schemas.Input))
 		if err != nil {
-			return fmt.Errorf("error compiling input schema: %w", err)
+			return ErrInvalidSchema.errorf("error compiling input schema: %w", err)
 		}
 		doc.inputSchema = s
 	}
@@ -92,14 +203,50 @@ func (doc *Document) LoadSchemas() error {
 	if doc.outputSchema == nil && doc.Schemas.Output != nil {
 		s, err := compileSchema(path.Join(doc.Filename, "schemas", "output"), doc.Schemas.Dialect, doc.Schemas.Output)
 		if err != nil {
-			return fmt.Errorf("error compiling output schema: %w", err)
+			return ErrInvalidSchema.errorf("error compiling output schema: %w", err)
 		}
 		doc.outputSchema = s
 	}
 
+	if doc.definitionSchemas == nil {
+		schemas := map[string]*jsonschema.Schema{}
+		for name, t := range doc.Definitions {
+			m, ok := t.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			input, ok := m["$input"].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			// Arguments should be strict, just like the input!
+			s, err := compileSchema(path.Join(doc.Filename, "definitions", name, "$input"), doc.Schemas.Dialect, strictObject(input))
+			if err != nil {
+				return ErrInvalidSchema.errorf("error compiling input schema for definition %s: %w", name, err)
+			}
+			schemas[name] = s
+		}
+		doc.definitionSchemas = schemas
+	}
+
 	return nil
 }
 
+// strictObject returns a copy of the schema which requires an object and
+// disallows additional properties unless they are explicitly configured.
+func strictObject(schema map[string]interface{}) map[string]interface{} {
+	tmp := make(map[string]interface{}, len(schema)+2)
+	for k, v := range schema {
+		tmp[k] = v
+	}
+	tmp["type"] = "object"
+	if tmp["additionalProperties"] == nil {
+		// Input should be strict!
+		tmp["additionalProperties"] = false
+	}
+	return tmp
+}
+
 func (doc *Document) Example() (interface{}, error) {
 	if doc.Schemas == nil || doc.Schemas.Input == nil {
 		return nil, nil
@@ -118,10 +265,20 @@ func (doc *Document) ValidateInput(params map[string]interface{}) error {
 
 	err := doc.inputSchema.Validate(params)
 	if err != nil {
-		return fmt.Errorf("error validating params against schema: %w", err)
+		suggestions := ""
+		if problems, ok := schemaProblems(err, doc.inputSchema, params); ok {
+			for _, p := range problems {
+				if p.property == "" {
+					continue
+				}
+				if hint := propertySuggestion(doc.inputSchema, p); hint != "" {
+					suggestions += fmt.Sprintf("\nproperty %s is not allowed%s", p.property, hint)
+				}
+			}
+		}
+		return ErrInvalidInput.errorf("error validating params against schema: %w%s", err, suggestions)
 	}
 
-	setDefaults(doc.inputSchema, params)
 	return nil
 }
 
@@ -129,26 +286,33 @@ func (doc *Document) ValidateInput(params map[string]interface{}) error {
 // correct based on the given schemas.
 func (doc *Document) ValidateTemplate() ([]ContextError, []ContextError) {
 	if doc.Schemas == nil || doc.Schemas.Input == nil {
-		return nil, []ContextError{&contextError{err: fmt.Errorf("input schema required")}}
+		return nil, []ContextError{&contextError{err: ErrInvalidSchema.errorf("input schema required")}}
 	}
 
 	doc.LoadSchemas()
 
+	if props, ok := doc.Schemas.Input["properties"].(map[string]interface{}); ok && props[constantsName] != nil {
+		ctx := newContext(doc, "schemas", "input", "properties", constantsName)
+		ctx.AddError(ErrInvalidSchema.errorf("error validating template: input property %s is reserved for constants", constantsName))
+		return nil, ctx.Meta.Errors
+	}
+
 	if doc.Schemas.Output == nil {
 		return nil, nil
 	}
 
-	ctx := newContext(doc.Filename, doc.ast, "template")
+	ctx := newContext(doc, "template")
 	example, err := generateExample(doc.inputSchema)
 	if err != nil {
-		return nil, []ContextError{&contextError{err: fmt.Errorf("error validating template: %w", err)}}
+		return nil, []ContextError{&contextError{err: ErrInvalidSchema.errorf("error validating template: %w", err)}}
 	}
-	validateTemplate(ctx, doc.outputSchema, doc.Template, example.(map[string]interface{}))
+	validateTemplate(ctx, doc.outputSchema, doc.Template, doc.withConstants(example.(map[string]interface{})))
 
-	warnings := []ContextError{}
+	warnings := append([]ContextError{}, ctx.Meta.Warnings...)
 	if ctx.Meta.TemplateComplexity > 50 {
 		warnings = append(warnings, &contextError{
-			err: fmt.Errorf("template complexity is high: %d", ctx.Meta.TemplateComplexity),
+			severity: SeverityWarning,
+			err:      ErrComplexity.errorf("template complexity is high: %d", ctx.Meta.TemplateComplexity),
 		})
 	}
 
@@ -161,11 +325,16 @@ func (doc *Document) ValidateOutput(output interface{}) error {
 		return nil
 	}
 
-	doc.LoadSchemas()
+	if err := doc.LoadSchemas(); err != nil {
+		return err
+	}
+	if doc.outputSchema == nil {
+		return ErrInvalidSchema.errorf("output schema could not be loaded")
+	}
 
-	err := doc.outputSchema.Validate(output)
+	err := doc.outputSchema.Validate(plainValue(output))
 	if err != nil {
-		return fmt.Errorf("error validating output against schema: %w", err)
+		return ErrInvalidOutput.errorf("error validating output against schema: %w", err)
 	}
 
 	return nil
@@ -173,8 +342,63 @@ func (doc *Document) ValidateOutput(output interface{}) error {
 
 // Render the template into a data structure.
 func (doc *Document) Render(params map[string]interface{}) (interface{}, []ContextError) {
+	return doc.render(gocontext.Background(), nil, params, nil)
+}
+
+// RenderContext renders the template into a data structure, stopping early
+// with an error if the context is canceled or any of the limits set in the
+// options are exceeded. The options may be nil.
+func (doc *Document) RenderContext(ctx gocontext.Context, params map[string]interface{}, opts *RenderOptions) (interface{}, []ContextError) {
+	return doc.render(ctx, nil, params, opts)
+}
+
+// render the template using the optional compiled program.
+func (doc *Document) render(goctx gocontext.Context, program *Program, params map[string]interface{}, opts *RenderOptions) (interface{}, []ContextError) {
 	doc.LoadSchemas()
+
+	// Params are copied so that converting numbers and setting defaults never
+	// modifies the caller's data, which may be shared between goroutines.
+	params = copyMap(params)
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+	coerceNumbers(doc.inputSchema, params)
 	setDefaults(doc.inputSchema, params)
-	ctx := newContext(doc.Filename, doc.ast, "template")
-	return render(ctx, doc.Template, params), ctx.Meta.Errors
+
+	ctx := newContext(doc, "template")
+	ctx.Program = program
+	ctx.Meta.Limits = newRenderLimits(goctx, opts)
+	if opts != nil && opts.PreserveOrder {
+		ctx.Meta.Order = newKeyOrder()
+	}
+	if opts != nil && opts.SourceMap != nil {
+		ctx.Meta.Sources = newSourceRecorder()
+	}
+
+	out := render(ctx, doc.Template, doc.withConstants(params))
+	if ctx.Meta.Sources != nil {
+		opts.SourceMap.build(ctx.Meta.Sources, out, ctx.Meta.Sources.last())
+	}
+	if ctx.Meta.Order != nil {
+		out = ctx.Meta.Order.apply(out)
+	}
+
+	return out, ctx.Meta.Errors
+}
+
+// withConstants returns a copy of the params with a deep copy of the
+// document's constants added under the reserved constants name, so the output
+// never shares values with the document. If there are no constants, then the
+// params are returned as-is.
+func (doc *Document) withConstants(params map[string]interface{}) map[string]interface{} {
+	if doc.Constants == nil {
+		return params
+	}
+
+	tmp := make(map[string]interface{}, len(params)+1)
+	for k, v := range params {
+		tmp[k] = v
+	}
+	tmp[constantsName] = copyMap(doc.Constants)
+	return tmp
 }
@@ -0,0 +1,157 @@
+package sdt
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorKind is a category of error with a stable code. Unlike error messages,
+// which may change between versions, codes can be relied on by tooling. Use
+// `errors.Is` to check whether an error is of a given kind, or `errors.As`
+// with an `*ErrorKind` target to get the kind of any error.
+type ErrorKind struct {
+	// Code is a stable machine-readable identifier, e.g. `type_mismatch`.
+	Code string
+
+	description string
+}
+
+func newErrorKind(code, description string) *ErrorKind {
+	return &ErrorKind{Code: code, description: description}
+}
+
+func (k *ErrorKind) Error() string {
+	return k.description
+}
+
+// errorf creates a new error of this kind. The message is formatted like
+// `fmt.Errorf`, including support for wrapping errors via `%w`.
+func (k *ErrorKind) errorf(format string, args ...interface{}) error {
+	return &kindError{kind: k, err: fmt.Errorf(format, args...)}
+}
+
+// Kinds of errors and warnings returned when validating and rendering.
+var (
+	// ErrInvalidSchema is returned when a document's schemas are missing or
+	// cannot be used.
+	ErrInvalidSchema = newErrorKind("invalid_schema", "invalid schema")
+
+	// ErrInvalidInput is returned when input params don't match the schema.
+	ErrInvalidInput = newErrorKind("invalid_input", "invalid input")
+
+	// ErrInvalidOutput is returned when the rendered output doesn't match the
+	// schema.
+	ErrInvalidOutput = newErrorKind("invalid_output", "invalid output")
+
+	// ErrTypeMismatch is returned when a value's type isn't allowed by the
+	// schema or operator, e.g. a string where a number is expected.
+	ErrTypeMismatch = newErrorKind("type_mismatch", "type mismatch")
+
+	// ErrSchemaMismatch is returned when a value doesn't match the schema for
+	// reasons other than its type, e.g. no `oneOf` schema matches.
+	ErrSchemaMismatch = newErrorKind("schema_mismatch", "schema mismatch")
+
+	// ErrUnknownProperty is returned when an object property isn't allowed
+	// by the schema.
+	ErrUnknownProperty = newErrorKind("unknown_property", "unknown property")
+
+	// ErrMissingProperty is returned when a property required by the output
+	// schema is missing from the template, or is a warning when it may be
+	// missing from the output on some paths.
+	ErrMissingProperty = newErrorKind("missing_property", "missing property")
+
+	// ErrInvalidOperator is returned when a special operator like `$if` or
+	// `$for` is used incorrectly, e.g. missing a required clause.
+	ErrInvalidOperator = newErrorKind("invalid_operator", "invalid operator")
+
+	// ErrExprCompile is returned when a `${...}` expression can't be parsed.
+	ErrExprCompile = newErrorKind("expr_compile", "invalid expression")
+
+	// ErrExprEval is returned when a `${...}` expression fails to evaluate.
+	ErrExprEval = newErrorKind("expr_eval", "expression evaluation failed")
+
+	// ErrNotIterable is returned when a value that must be looped over is not
+	// an array or object.
+	ErrNotIterable = newErrorKind("not_iterable", "value is not iterable")
+
+	// ErrDuplicateKey is returned when a keyed `$for` loop generates the same
+	// key more than once.
+	ErrDuplicateKey = newErrorKind("duplicate_key", "duplicate key")
+
+	// ErrDefinitionNotFound is returned when a `$ref` or `$call` names a
+	// definition which doesn't exist.
+	ErrDefinitionNotFound = newErrorKind("definition_not_found", "definition not found")
+
+	// ErrInvalidArguments is returned when `$call` arguments don't match the
+	// definition's `$input` schema.
+	ErrInvalidArguments = newErrorKind("invalid_arguments", "invalid arguments")
+
+	// ErrInclude is returned when an `$include` file can't be loaded.
+	ErrInclude = newErrorKind("include_failed", "unable to include")
+
+	// ErrIncludeCycle is returned when documents include each other.
+	ErrIncludeCycle = newErrorKind("include_cycle", "include cycle")
+
+	// ErrUnreachableCase is a warning for a `$case` which can never match.
+	ErrUnreachableCase = newErrorKind("unreachable_case", "unreachable case")
+
+	// ErrUnhandledCase is a warning for a `$switch` which doesn't handle all
+	// possible values.
+	ErrUnhandledCase = newErrorKind("unhandled_case", "unhandled case")
+
+	// ErrComplexity is a warning for templates which are overly complex.
+	ErrComplexity = newErrorKind("high_complexity", "template complexity is high")
+)
+
+// kindError is an error of a specific kind. The message of the wrapped error
+// is used as-is.
+type kindError struct {
+	kind *ErrorKind
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+// Is returns whether the error is of the target kind.
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// As sets an `*ErrorKind` target to the error's kind.
+func (e *kindError) As(target interface{}) bool {
+	if k, ok := target.(**ErrorKind); ok {
+		*k = e.kind
+		return true
+	}
+	return false
+}
+
+// ErrorCode returns the stable code for the kind of the error, or an empty
+// string if the error has no known kind.
+func ErrorCode(err error) string {
+	var kind *ErrorKind
+	if errors.As(err, &kind) {
+		return kind.Code
+	}
+	return ""
+}
+
+// Severity describes whether a problem prevents the template from being used.
+type Severity string
+
+// Severities of problems found when validating and rendering.
+const (
+	// SeverityError is a problem which prevents validation or rendering from
+	// succeeding.
+	SeverityError Severity = "error"
+
+	// SeverityWarning is a likely mistake which does not prevent the template
+	// from rendering.
+	SeverityWarning Severity = "warning"
+)
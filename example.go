@@ -11,10 +11,37 @@ import (
 // instance in Go with discrete types that can be used for the expression
 // type checker.
 func generateExample(s *jsonschema.Schema) (interface{}, error) {
+	for s.Ref != nil {
+		s = s.Ref
+	}
+	if _, ok := s.AdditionalProperties.(*jsonschema.Schema); ok && len(s.Properties) == 0 {
+		// Top-level names can't be type checked if they aren't known ahead of
+		// time. Nested objects like this are fine, but have no example
+		// properties since their names aren't known.
+		return nil, fmt.Errorf("additionalProperties not supported")
+	}
+	return generateExampleRecursive(s, map[*jsonschema.Schema]int{})
+}
+
+// generateExampleRecursive generates an example while keeping track of the
+// schemas currently being processed, so that recursive schemas terminate.
+// Recursive schemas are expanded one level deep so that expressions which
+// access nested items can still be type checked.
+func generateExampleRecursive(s *jsonschema.Schema, visited map[*jsonschema.Schema]int) (interface{}, error) {
 	if s.Ref != nil {
-		return generateExample(s.Ref)
+		return generateExampleRecursive(s.Ref, visited)
 	}
 
+	if visited[s] > 1 {
+		// This is a recursive schema, so stop here with an empty value.
+		if hasType(s, "object") {
+			return map[string]interface{}{}, nil
+		}
+		return nil, nil
+	}
+	visited[s]++
+	defer func() { visited[s]-- }()
+
 	if len(s.Types) > 1 {
 		return nil, fmt.Errorf("multiple types not supported")
 	}
@@ -41,22 +68,16 @@ func generateExample(s *jsonschema.Schema) (interface{}, error) {
 	case "string":
 		return "string", nil
 	case "array":
-		example, err := generateExample(getItems(s))
+		example, err := generateExampleRecursive(getItems(s), visited)
 		if err != nil {
 			return nil, err
 		}
 		return []interface{}{example, example, example}, nil
 	case "object":
-		if s.AdditionalProperties != nil {
-			// Ignore `additionalProperties: false`, fail everything else.
-			if _, ok := s.AdditionalProperties.(bool); !ok {
-				return nil, fmt.Errorf("additionalProperties not supported")
-			}
-		}
-
 		tmp := map[string]interface{}{}
+
 		for k, v := range s.Properties {
-			example, err := generateExample(v)
+			example, err := generateExampleRecursive(v, visited)
 			if err != nil {
 				return nil, err
 			}
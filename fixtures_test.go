@@ -1,61 +1,23 @@
 package sdt
 
 import (
+	gocontext "context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gopkg.in/yaml.v3"
 )
 
-type Test struct {
-	Name     string                 `json:"name" yaml:"name"`
-	Input    map[string]interface{} `json:"input" yaml:"input"`
-	Errors   []string               `json:"errors" yaml:"errors"`
-	Expected interface{}            `json:"expected" yaml:"expected"`
-}
-
-func (test *Test) ErrorsFail(t testing.TB, errs interface{}) bool {
-	if e, ok := errs.([]ContextError); ok {
-		if len(e) > 0 {
-			if len(test.Errors) > 0 {
-				// We expected errors. Match them!
-			outer:
-				for _, expected := range test.Errors {
-					for _, actual := range e {
-						if strings.Contains(actual.Error(), expected) {
-							continue outer
-						}
-					}
-					t.Error(fmt.Errorf("expected '%s' but found %v", expected, errs))
-				}
-
-				return true
-			}
-		}
-	}
-
-	if e, ok := errs.(error); ok {
-		if e != nil {
-			for _, expected := range test.Errors {
-				if strings.Contains(e.Error(), expected) {
-					continue
-				}
-
-				t.Error(fmt.Errorf("expected '%s' but found %v", expected, errs))
-			}
-			return true
-		}
-	}
-
-	return false
-}
-
 type Fixture struct {
 	Name     string   `json:"-"`
 	Document Document `json:"document" yaml:"document"`
@@ -85,7 +47,7 @@ func getFixtures(t testing.TB) []*Fixture {
 			}
 			f.Name = file.Name()
 			f.Document.Filename = filename + "#/document"
-			docBytes, _ := yaml.Marshal(f.Document)
+			docBytes, _ := yaml.Marshal(&f.Document)
 			f.Document.LoadAST(docBytes)
 
 			fixtures = append(fixtures, f)
@@ -99,37 +61,936 @@ func TestFixtures(t *testing.T) {
 	for _, f := range getFixtures(t) {
 		for i, test := range f.Tests {
 			t.Run(fmt.Sprintf("%s-%d-%s", f.Name, i, test.Name), func(t *testing.T) {
-				_, errs := f.Document.ValidateTemplate()
-				if test.ErrorsFail(t, errs) {
-					return
+				result := f.Document.RunTest(&test)
+				for _, failure := range result.Failures {
+					t.Error(failure)
 				}
-
-				err := f.Document.ValidateInput(test.Input)
-				if test.ErrorsFail(t, err) {
-					return
+				for _, d := range result.Diff {
+					t.Error(d)
 				}
+			})
+		}
+	}
+}
 
-				out, errs := f.Document.Render(test.Input)
-				if test.ErrorsFail(t, errs) {
-					return
-				}
+func TestCompiledFixtures(t *testing.T) {
+	for _, f := range getFixtures(t) {
+		for i, test := range f.Tests {
+			if test.Errors != nil {
+				continue
+			}
 
-				err = f.Document.ValidateOutput(out)
-				if test.ErrorsFail(t, err) {
-					return
+			t.Run(fmt.Sprintf("%s-%d-%s", f.Name, i, test.Name), func(t *testing.T) {
+				program, errs := f.Document.Compile()
+				require.Empty(t, errs)
+
+				expected, errs := f.Document.Render(test.Input)
+				require.Empty(t, errs)
+
+				// Render twice to ensure compiled expressions are reusable.
+				for j := 0; j < 2; j++ {
+					actual, errs := program.Render(test.Input)
+					require.Empty(t, errs)
+					assert.Equal(t, expected, actual)
 				}
+			})
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	doc, err := NewFromBytes("compile.yaml", []byte(`
+schemas:
+  input: {}
+template:
+  foo: ${1 +}
+  bar: ${unterminated
+`))
+	require.NoError(t, err)
+
+	_, errs := doc.Compile()
+	require.Len(t, errs, 2)
+	assert.Equal(t, "compile.yaml#/template/bar", errs[0].Path())
+	assert.Contains(t, errs[0].Message(), "unterminated expression")
+	assert.Equal(t, "compile.yaml#/template/foo", errs[1].Path())
+}
+
+func TestCompileIncludeCycle(t *testing.T) {
+	for _, f := range getFixtures(t) {
+		if f.Name != "include_cycle.yaml" {
+			continue
+		}
+
+		_, errs := f.Document.Compile()
+		require.Len(t, errs, 1)
+		assert.Contains(t, errs[0].Message(), "include cycle detected")
+		assert.Contains(t, errs[0].Message(), "cycle_a.yaml -> ")
+	}
+}
 
-				// Round trip to normalize all numbers in the output to make writing
-				// test expectations easier in YAML.
-				tmp, _ := yaml.Marshal(out)
-				yaml.Unmarshal(tmp, &out)
+func TestCompileOperators(t *testing.T) {
+	doc, err := NewFromBytes("compile.yaml", []byte(`
+schemas:
+  input: {}
+definitions:
+  greeting: Hello, ${name}!
+template:
+  message:
+    $call: greeting
+    $with:
+      name: world
+`))
+	require.NoError(t, err)
 
-				assert.EqualValues(t, test.Expected, out)
+	program, errs := doc.Compile()
+	require.Empty(t, errs)
+
+	// Operators and their definitions are resolved when compiling, so the
+	// program doesn't look them up again.
+	doc.Definitions = nil
+
+	out, errs := program.Render(map[string]interface{}{})
+	require.Empty(t, errs)
+	assert.Equal(t, map[string]interface{}{"message": "Hello, world!"}, out)
+}
+
+func TestConcurrentRender(t *testing.T) {
+	// Use freshly loaded documents so that lazy initialization also happens
+	// concurrently. Run with `-race` to detect data races.
+	for _, f := range getFixtures(t) {
+		f := f
+		for i, test := range f.Tests {
+			if test.Errors != nil {
+				continue
+			}
+			test := test
+
+			t.Run(fmt.Sprintf("%s-%d-%s", f.Name, i, test.Name), func(t *testing.T) {
+				t.Parallel()
+
+				original := copyMap(test.Input)
+				program, errs := f.Document.Compile()
+				require.Empty(t, errs)
+
+				var wg sync.WaitGroup
+				for j := 0; j < 4; j++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						_, errs := f.Document.ValidateTemplate()
+						assert.Empty(t, errs)
+						assert.NoError(t, f.Document.ValidateInput(test.Input))
+						expected, errs := f.Document.Render(test.Input)
+						assert.Empty(t, errs)
+						actual, errs := program.Render(test.Input)
+						assert.Empty(t, errs)
+						assert.Equal(t, expected, actual)
+					}()
+				}
+				wg.Wait()
+
+				assert.Equal(t, original, test.Input, "params must not be modified")
 			})
 		}
 	}
 }
 
+func TestRenderLimits(t *testing.T) {
+	doc, err := NewFromBytes("limits.yaml", []byte(`
+schemas:
+  input:
+    type: object
+    properties:
+      items:
+        type: array
+        items:
+          type: string
+template:
+  names:
+    $for: ${items}
+    $each:
+      $for: ${items}
+      $as: inner
+      $each: ${item}-${inner}
+`))
+	require.NoError(t, err)
+
+	recursive, err := NewFromBytes("recursive.yaml", []byte(`
+schemas:
+  input: {}
+definitions:
+  nested:
+    deeper:
+      $ref: "#/definitions/nested"
+template:
+  $ref: "#/definitions/nested"
+`))
+	require.NoError(t, err)
+
+	params := map[string]interface{}{
+		"items": []interface{}{"a", "b", "c"},
+	}
+
+	canceled, cancel := gocontext.WithCancel(gocontext.Background())
+	cancel()
+
+	cases := []struct {
+		name string
+		doc  *Document
+		ctx  gocontext.Context
+		opts *RenderOptions
+		err  error
+		path string
+	}{
+		{"canceled", doc, canceled, nil, ErrCanceled, "limits.yaml#/template"},
+		{"depth", recursive, gocontext.Background(), &RenderOptions{MaxDepth: 10}, ErrMaxDepth, ""},
+		{"iterations", doc, gocontext.Background(), &RenderOptions{MaxLoopIterations: 10}, ErrMaxLoopIterations, "limits.yaml#/template/names/$each/$for"},
+		{"nodes", doc, gocontext.Background(), &RenderOptions{MaxNodes: 5}, ErrMaxNodes, ""},
+		{"string", doc, gocontext.Background(), &RenderOptions{MaxStringLength: 2}, ErrMaxStringLength, "limits.yaml#/template/names/$each/$each"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, errs := c.doc.RenderContext(c.ctx, params, c.opts)
+			require.Len(t, errs, 1)
+			assert.True(t, errors.Is(errs[0], c.err), errs[0].Error())
+			if c.path != "" {
+				assert.Equal(t, c.path, errs[0].Path())
+			}
+		})
+	}
+
+	// Limits that are not exceeded render normally.
+	out, errs := doc.RenderContext(gocontext.Background(), params, &RenderOptions{
+		MaxDepth:          10,
+		MaxLoopIterations: 12,
+		MaxNodes:          100,
+		MaxStringLength:   3,
+	})
+	require.Empty(t, errs)
+	assert.Len(t, out.(map[string]interface{})["names"], 3)
+}
+
+func TestPreserveOrder(t *testing.T) {
+	doc, err := NewFromBytes("order.yaml", []byte(`
+schemas:
+  input:
+    type: object
+    properties:
+      extra:
+        type: object
+        additionalProperties:
+          type: string
+      names:
+        type: array
+        items:
+          type: string
+template:
+  kind: Deployment
+  apiVersion: apps/v1
+  metadata:
+    name: test
+    $spread: ${extra}
+    annotations:
+      $merge:
+        - {zeta: "1", alpha: "2"}
+        - {beta: "3"}
+  items:
+    $for: ${names}
+    $each:
+      value: ${item}
+      id: ${loop.index}
+  keyed:
+    $for: ${names}
+    $key: ${item}
+    $each: ${loop.index}
+  raw:
+    $literal: {b: 1, a: 2}
+  shared: &shared {zulu: 1, mike: 2}
+  reused: *shared
+`))
+	require.NoError(t, err)
+
+	params := map[string]interface{}{
+		"extra": map[string]interface{}{"labels": "a", "app": "b"},
+		"names": []interface{}{"zed", "bob"},
+	}
+
+	out, errs := doc.RenderContext(gocontext.Background(), params, &RenderOptions{PreserveOrder: true})
+	require.Empty(t, errs)
+	require.NoError(t, doc.ValidateOutput(out))
+
+	expected := `{"kind":"Deployment","apiVersion":"apps/v1","metadata":{"name":"test","app":"b","labels":"a","annotations":{"zeta":"1","alpha":"2","beta":"3"}},"items":[{"value":"zed","id":0},{"value":"bob","id":1}],"keyed":{"zed":0,"bob":1},"raw":{"b":1,"a":2},"shared":{"zulu":1,"mike":2},"reused":{"zulu":1,"mike":2}}`
+
+	b, err := json.Marshal(out)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(b))
+
+	y, err := yaml.Marshal(out)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(y), "kind: Deployment\napiVersion: apps/v1\n"), string(y))
+
+	// Compiled programs keep the same order.
+	p, errs := doc.Compile()
+	require.Empty(t, errs)
+	out, errs = p.RenderContext(gocontext.Background(), params, &RenderOptions{PreserveOrder: true})
+	require.Empty(t, errs)
+	b, err = json.Marshal(out)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(b))
+
+	// Without the option, keys are sorted as usual.
+	out, errs = doc.Render(params)
+	require.Empty(t, errs)
+	b, err = json.Marshal(out)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(b), `{"apiVersion":"apps/v1","items":`), string(b))
+}
+
+func TestConstantsCopied(t *testing.T) {
+	doc, err := NewFromBytes("constants.yaml", []byte(`
+schemas:
+  input:
+    type: object
+constants:
+  labels:
+    team: web
+  zones: [a, b]
+template:
+  labels: ${const.labels}
+  zones: ${const.zones}
+`))
+	require.NoError(t, err)
+
+	out, errs := doc.Render(map[string]interface{}{})
+	require.Empty(t, errs)
+
+	// Modifying the output must not change the document's constants.
+	m := out.(map[string]interface{})
+	m["labels"].(map[string]interface{})["team"] = "changed"
+	m["zones"].([]interface{})[0] = "changed"
+	assert.Equal(t, map[string]interface{}{
+		"labels": map[string]interface{}{"team": "web"},
+		"zones":  []interface{}{"a", "b"},
+	}, doc.Constants)
+}
+
+func TestNumberPrecision(t *testing.T) {
+	doc, err := NewFromBytes("numbers.yaml", []byte(`
+schemas:
+  input:
+    type: object
+    properties:
+      id:
+        type: integer
+      count:
+        type: integer
+      price:
+        type: number
+      big:
+        type: number
+template:
+  id: ${id}
+  count: ${count}
+  price: ${price}
+  big: ${big}
+  label: ${id}-${price}
+`))
+	require.NoError(t, err)
+
+	// Params decoded via `UseNumber` keep all their digits.
+	params := map[string]interface{}{
+		"id":    json.Number("9007199254740993"),
+		"count": json.Number("1e3"),
+		"price": json.Number("0.1"),
+		"big":   json.Number("0.1000000000000000000001"),
+	}
+
+	out, errs := doc.Render(params)
+	require.Empty(t, errs)
+	assert.Equal(t, map[string]interface{}{
+		"id":    int64(9007199254740993),
+		"count": int64(1000),
+		"price": 0.1,
+		"big":   json.Number("0.1000000000000000000001"),
+		"label": "9007199254740993-0.1",
+	}, out)
+
+	// The caller's params are not modified.
+	assert.Equal(t, json.Number("1e3"), params["count"])
+
+	b, err := json.Marshal(out)
+	require.NoError(t, err)
+	assert.Equal(t, `{"big":0.1000000000000000000001,"count":1000,"id":9007199254740993,"label":"9007199254740993-0.1","price":0.1}`, string(b))
+
+	// Expressions which compute a value use floats, so numbers which can't be
+	// represented exactly are converted, except for large integers which
+	// would silently lose precision.
+	doc, err = NewFromBytes("numbers.yaml", []byte(`
+schemas:
+  input:
+    type: object
+    properties:
+      id:
+        type: integer
+      big:
+        type: number
+template:
+  double: ${big * 2}
+  positive: ${big > 0}
+  next: ${id + 1}
+`))
+	require.NoError(t, err)
+
+	out, errs = doc.Render(map[string]interface{}{
+		"id":  json.Number("9007199254740993"),
+		"big": json.Number("0.1000000000000000000001"),
+	})
+	require.Len(t, errs, 1)
+	assert.Equal(t, "numbers.yaml#/template/next", errs[0].Path())
+	assert.Contains(t, errs[0].Message(), "integer 9007199254740993 is too large to use in an expression without losing precision")
+	assert.Equal(t, map[string]interface{}{
+		"double":   0.2,
+		"positive": true,
+	}, out)
+
+	// Large integers which fit in a float are fine.
+	out, errs = doc.Render(map[string]interface{}{
+		"id":  json.Number("9007199254740991"),
+		"big": json.Number("1.5"),
+	})
+	require.Empty(t, errs)
+	assert.Equal(t, int64(9007199254740992), out.(map[string]interface{})["next"])
+
+	// Numbers are found within objects and arrays, including computed indexes
+	// which the interpreter evaluates against the selected object.
+	doc, err = NewFromBytes("numbers.yaml", []byte(`
+schemas:
+  input:
+    type: object
+    properties:
+      order:
+        type: object
+        properties:
+          prices:
+            type: array
+            items:
+              type: number
+          n:
+            type: integer
+template:
+  first: ${order.prices[0] * 2}
+  last: ${order.prices[-1] * 2}
+  nth: ${order.prices[n] * 2}
+`))
+	require.NoError(t, err)
+
+	out, errs = doc.Render(map[string]interface{}{
+		"order": map[string]interface{}{
+			"prices": []interface{}{
+				json.Number("1.5000000000000000000001"),
+				json.Number("2.5000000000000000000001"),
+				json.Number("3.5000000000000000000001"),
+			},
+			"n": json.Number("1"),
+		},
+	})
+	require.Empty(t, errs)
+	assert.Equal(t, map[string]interface{}{
+		"first": int64(3),
+		"last":  int64(7),
+		"nth":   int64(5),
+	}, out)
+}
+
+func TestErrorCodes(t *testing.T) {
+	doc, err := NewFromBytes("codes.yaml", []byte(`
+schemas:
+  input:
+    type: object
+    properties:
+      tier:
+        type: string
+        enum: [small, large]
+      count:
+        type: integer
+  output:
+    type: object
+    properties:
+      size:
+        type: number
+      name:
+        type: string
+      items:
+        type: array
+template:
+  size:
+    $switch: ${tier}
+    $case:
+      small: 1
+  name: ${count}
+  items:
+    $for: ${tier}
+    $each: ${item}
+`))
+	require.NoError(t, err)
+
+	warnings, errs := doc.ValidateTemplate()
+	require.Len(t, warnings, 1)
+	assert.Equal(t, "unhandled_case", warnings[0].Code())
+	assert.Equal(t, SeverityWarning, warnings[0].Severity())
+	assert.True(t, errors.Is(warnings[0], ErrUnhandledCase))
+
+	require.Len(t, errs, 2)
+	codes := []string{errs[0].Code(), errs[1].Code()}
+	assert.ElementsMatch(t, []string{"type_mismatch", "not_iterable"}, codes)
+	for _, e := range errs {
+		assert.Equal(t, SeverityError, e.Severity())
+
+		var kind *ErrorKind
+		require.True(t, errors.As(e, &kind))
+		assert.Equal(t, e.Code(), kind.Code)
+	}
+
+	// Messages are unchanged by the error kinds.
+	assert.Contains(t, errs[0].Message(), "error validating template:")
+
+	err = doc.ValidateInput(map[string]interface{}{"tier": "medium"})
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrInvalidInput))
+	assert.Equal(t, "invalid_input", ErrorCode(err))
+	assert.Equal(t, "", ErrorCode(errors.New("other")))
+
+	// Render errors and limits have codes too.
+	_, errs = doc.RenderContext(gocontext.Background(), map[string]interface{}{"tier": "small"}, &RenderOptions{MaxNodes: 1})
+	require.Len(t, errs, 1)
+	assert.Equal(t, "max_nodes", errs[0].Code())
+	assert.True(t, errors.Is(errs[0], ErrMaxNodes))
+}
+
+func TestValidateParams(t *testing.T) {
+	doc, err := NewFromBytes("params.yaml", []byte(`
+schemas:
+  input:
+    type: object
+    properties:
+      name:
+        type: string
+      tags:
+        type: array
+        items:
+          type: object
+          additionalProperties: false
+          properties:
+            id:
+              type: integer
+template:
+  name: ${name}
+`))
+	require.NoError(t, err)
+
+	params, err := ParseParams("params.yaml", []byte(`name: test
+tags:
+  - id: 9007199254740993
+  - id: two
+    extra: true
+`))
+	require.NoError(t, err)
+	assert.Equal(t, json.Number("9007199254740993"), params.Values["tags"].([]interface{})[0].(map[string]interface{})["id"])
+
+	errs := doc.ValidateParams(params)
+	require.Len(t, errs, 2)
+
+	assert.Equal(t, "params.yaml#/tags/1/extra", errs[0].Path())
+	assert.Equal(t, 5, errs[0].Line())
+	assert.Equal(t, "unknown_property", errs[0].Code())
+	assert.Contains(t, errs[0].Message(), "property extra is not allowed")
+
+	assert.Equal(t, "params.yaml#/tags/1/id", errs[1].Path())
+	assert.Equal(t, 4, errs[1].Line())
+	assert.Equal(t, 9, errs[1].Column())
+	assert.Equal(t, "invalid_input", errs[1].Code())
+	assert.Contains(t, errs[1].Message(), "expected integer")
+	assert.Contains(t, errs[1].Error(), "^^^")
+
+	valid, err := ParseParams("params.json", []byte(`{"name": "test"}`))
+	require.NoError(t, err)
+	assert.Empty(t, doc.ValidateParams(valid))
+
+	// Errors for merged values are reported against their own source.
+	merged, err := ParseParams("params.yaml", []byte(`name: test
+tags:
+  - id: 1
+`))
+	require.NoError(t, err)
+	merged.Merge(&Params{Filename: "args", Values: map[string]interface{}{
+		"name": 5,
+	}})
+	assert.Equal(t, 5, merged.Values["name"])
+	assert.NotNil(t, merged.Values["tags"])
+
+	errs = doc.ValidateParams(merged)
+	require.Len(t, errs, 1)
+	assert.Equal(t, "args#/name", errs[0].Path())
+	assert.Equal(t, 0, errs[0].Line())
+
+	// Keys which need escaping keep their names and source locations.
+	doc, err = NewFromBytes("params.yaml", []byte(`
+schemas:
+  input:
+    type: object
+    properties:
+      labels:
+        type: object
+        additionalProperties: false
+        properties:
+          a/b:
+            type: integer
+        patternProperties:
+          "^x-":
+            type: integer
+template:
+  labels: ${labels}
+`))
+	require.NoError(t, err)
+
+	escaped, err := ParseParams("params.yaml", []byte(`labels:
+  a/b: two
+  x-ok: 1
+  it's: 1
+`))
+	require.NoError(t, err)
+
+	errs = doc.ValidateParams(escaped)
+	require.Len(t, errs, 2)
+
+	assert.Equal(t, "params.yaml#/labels/it's", errs[0].Path())
+	assert.Equal(t, 4, errs[0].Line())
+	assert.Contains(t, errs[0].Message(), "property it's is not allowed")
+
+	assert.Equal(t, "params.yaml#/labels/a~1b", errs[1].Path())
+	assert.Equal(t, 2, errs[1].Line())
+	assert.Contains(t, errs[1].Message(), "expected integer")
+}
+
+func TestSuggestions(t *testing.T) {
+	options := []string{"name", "email", "tags"}
+	assert.Equal(t, "name", closest("nmae", options))
+	assert.Equal(t, "email", closest("Emial", options))
+	assert.Equal(t, "tags", closest("tag", options))
+	assert.Equal(t, "", closest("id", options))
+	assert.Equal(t, "", closest("name", options))
+	assert.Equal(t, "$else", closest("$esle", operatorNames))
+
+	doc, err := NewFromBytes("params.yaml", []byte(`
+schemas:
+  input:
+    type: object
+    properties:
+      user:
+        type: object
+        additionalProperties: false
+        properties:
+          email:
+            type: string
+template:
+  email: ${user.email}
+`))
+	require.NoError(t, err)
+
+	params, err := ParseParams("params.yaml", []byte(`user:
+  emial: test@example.com
+`))
+	require.NoError(t, err)
+
+	errs := doc.ValidateParams(params)
+	require.Len(t, errs, 1)
+	assert.Equal(t, "params.yaml#/user/emial", errs[0].Path())
+	assert.Contains(t, errs[0].Message(), "property emial is not allowed, did you mean 'email'?")
+}
+
+func TestSourceMap(t *testing.T) {
+	doc, err := NewFromBytes("sources.yaml", []byte(`
+schemas:
+  input: {}
+  output:
+    type: object
+    properties:
+      items:
+        type: array
+        items:
+          type: object
+          properties:
+            id:
+              type: integer
+          additionalProperties: false
+      flat:
+        type: array
+        items:
+          type: integer
+      merged:
+        type: object
+        additionalProperties:
+          type: string
+      status:
+        type: string
+definitions:
+  item:
+    id: ${item}
+template:
+  items:
+    $for: ${ids}
+    $each:
+      $ref: "#/definitions/item"
+  flat:
+    $flatten:
+      - [1, 2]
+      - $for: ${ids}
+        $each: ${item}
+  merged:
+    $merge:
+      - a: static
+      - $spread: ${extra}
+  status:
+    $if: ${ok}
+    $then: ${ok}
+    $else: failed
+`))
+	require.NoError(t, err)
+
+	params := map[string]interface{}{
+		"ids":   []interface{}{1, "two"},
+		"extra": map[string]interface{}{"b": 5},
+		"ok":    true,
+	}
+
+	sources := &SourceMap{}
+	out, errs := doc.RenderContext(gocontext.Background(), params, &RenderOptions{SourceMap: sources})
+	require.Empty(t, errs)
+
+	for path, expected := range map[string]string{
+		"":             "sources.yaml#/template",
+		"/items/1":     "sources.yaml#/definitions/item",
+		"/items/1/id":  "sources.yaml#/definitions/item/id",
+		"/flat/1":      "sources.yaml#/template/flat/$flatten/0/1",
+		"/flat/3":      "sources.yaml#/template/flat/$flatten/1/$each",
+		"/merged/a":    "sources.yaml#/template/merged/$merge/0/a",
+		"/merged/b":    "sources.yaml#/template/merged/$merge/1/$spread",
+		"/status":      "sources.yaml#/template/status/$then",
+		"/status/deep": "sources.yaml#/template/status/$then",
+	} {
+		actual, ok := sources.Lookup(path)
+		assert.True(t, ok, path)
+		assert.Equal(t, expected, actual, path)
+	}
+
+	errs = doc.ValidateOutputSources(out, sources)
+	require.Len(t, errs, 4)
+
+	assert.Equal(t, "sources.yaml#/template/flat/$flatten/1/$each", errs[0].Path())
+	assert.Contains(t, errs[0].Message(), "error validating output at /flat/3: expected integer, but got string, rendered value: two")
+
+	assert.Equal(t, "sources.yaml#/definitions/item/id", errs[1].Path())
+	assert.Contains(t, errs[1].Message(), "at /items/1/id")
+	assert.Equal(t, "invalid_output", errs[1].Code())
+	assert.NotZero(t, errs[1].Line())
+
+	assert.Equal(t, "sources.yaml#/template/merged/$merge/1/$spread", errs[2].Path())
+	assert.Contains(t, errs[2].Message(), "rendered value: 5")
+
+	assert.Equal(t, "sources.yaml#/template/status/$then", errs[3].Path())
+	assert.Contains(t, errs[3].Message(), "rendered value: true")
+
+	// Schemas which can't be loaded are reported rather than panicking.
+	doc, err = NewFromBytes("unresolved.yaml", []byte(`
+schemas:
+  input: {}
+  output:
+    $ref: missing.json
+template: value
+`))
+	require.NoError(t, err)
+	errs = doc.ValidateOutputSources("value", &SourceMap{})
+	require.Len(t, errs, 1)
+	assert.Equal(t, "invalid_schema", errs[0].Code())
+	assert.Equal(t, "unresolved.yaml#/schemas/output", errs[0].Path())
+	assert.True(t, errors.Is(doc.ValidateOutput("value"), ErrInvalidSchema))
+}
+
+func TestSidecarTests(t *testing.T) {
+	doc, err := NewFromFile("samples/hello/hello.sdt.yaml")
+	require.NoError(t, err)
+	require.NoError(t, doc.LoadTests())
+	require.NotEmpty(t, doc.Tests)
+
+	for _, result := range doc.RunTests() {
+		assert.True(t, result.Passed(), "%s: %v %v", result.Name, result.Failures, result.Diff)
+	}
+}
+
+func TestTestDiff(t *testing.T) {
+	doc := New("")
+	doc.Schemas.Input = map[string]interface{}{}
+	doc.Template = map[string]interface{}{
+		"foo": "bar",
+		"baz": []interface{}{1, 2},
+	}
+
+	result := doc.RunTest(&Test{
+		Expected: map[string]interface{}{
+			"foo": "other",
+			"baz": []interface{}{1},
+			"new": true,
+		},
+	})
+
+	assert.False(t, result.Passed())
+	assert.Equal(t, []string{
+		"/baz/1: unexpected 2",
+		"/foo: expected other but found bar",
+		"/new: missing, expected true",
+	}, result.Diff)
+}
+
+func TestSwitchWarnings(t *testing.T) {
+	doc, err := NewFromBytes("switch.yaml", []byte(`
+schemas:
+  input:
+    type: object
+    properties:
+      tier:
+        type: string
+        enum: [small, medium, large]
+  output:
+    type: string
+template:
+  $switch: ${tier}
+  $case:
+    small: a
+    medium: b
+    huge: c
+`))
+	require.NoError(t, err)
+
+	warnings, errs := doc.ValidateTemplate()
+	require.Empty(t, errs)
+	require.Len(t, warnings, 2)
+	assert.Contains(t, warnings[0].Message(), "$case huge can never match")
+	assert.Equal(t, "switch.yaml#/template/$case/huge", warnings[0].Path())
+	assert.Contains(t, warnings[1].Message(), "$switch does not handle [large]")
+}
+
+func TestRequiredWarnings(t *testing.T) {
+	doc, err := NewFromBytes("required.yaml", []byte(`
+schemas:
+  input:
+    type: object
+    required: [user]
+    properties:
+      name:
+        type: string
+      title:
+        type: string
+        default: Guest
+      enabled:
+        type: boolean
+      user:
+        type: object
+        properties:
+          email:
+            type: string
+      names:
+        type: array
+        items:
+          type: string
+  output:
+    type: object
+    required: [name, title, email, status, merged]
+    properties:
+      name:
+        type: string
+      title:
+        type: string
+      email:
+        type: string
+      status:
+        type: string
+      merged:
+        type: object
+        required: [a, b]
+        properties:
+          a:
+            type: string
+          b:
+            type: string
+      people:
+        type: array
+        items:
+          type: object
+          required: [name]
+          properties:
+            name:
+              type: string
+      greeting:
+        type: object
+        required: [name]
+        properties:
+          name:
+            type: string
+      dynamic:
+        type: object
+        required: [id]
+template:
+  name: ${name}
+  title: ${title}
+  email: ${user.email}
+  status:
+    $if: ${enabled}
+    $then: active
+  merged:
+    $merge:
+      - a: one
+      - b: two
+  # Local variables shadow the optional name param.
+  people:
+    $for: ${names}
+    $as: name
+    $each:
+      name: ${name}
+  greeting:
+    $let:
+      name: Alice
+    $in:
+      name: ${name}
+  dynamic:
+    ${title}: 1
+`))
+	require.NoError(t, err)
+
+	warnings, errs := doc.ValidateTemplate()
+	require.Empty(t, errs)
+	require.Len(t, warnings, 4)
+
+	// Nested objects are validated in any order.
+	byPath := map[string]ContextError{}
+	for _, w := range warnings {
+		assert.Equal(t, "missing_property", w.Code())
+		byPath[w.Path()] = w
+	}
+
+	require.Contains(t, byPath, "required.yaml#/template/name")
+	assert.Contains(t, byPath["required.yaml#/template/name"].Message(), "required property name may be missing: `name` is optional in input schema and has no default")
+
+	require.Contains(t, byPath, "required.yaml#/template/email")
+	assert.Contains(t, byPath["required.yaml#/template/email"].Message(), "`user.email` is optional in input schema")
+
+	require.Contains(t, byPath, "required.yaml#/template/status")
+	assert.Contains(t, byPath["required.yaml#/template/status"].Message(), "$if has no $else")
+
+	require.Contains(t, byPath, "required.yaml#/template/dynamic")
+	assert.Contains(t, byPath["required.yaml#/template/dynamic"].Message(), "required property id may be missing: it is only output if ${title} renders as id")
+}
+
 func BenchmarkFixtures(b *testing.B) {
 	for _, f := range getFixtures(b) {
 		for i, test := range f.Tests {
@@ -147,16 +1008,16 @@ func BenchmarkFixtures(b *testing.B) {
 			b.Run(fmt.Sprintf("CheckTemplate-%s-%d-%s", f.Name, i, test.Name), func(b *testing.B) {
 				for j := 0; j < b.N; j++ {
 					_, errs := f.Document.ValidateTemplate()
-					if test.ErrorsFail(b, errs) {
-						return
+					if len(errs) > 0 {
+						b.Fatal(errs)
 					}
 				}
 			})
 			b.Run(fmt.Sprintf("CheckInput-%s-%d-%s", f.Name, i, test.Name), func(b *testing.B) {
 				for j := 0; j < b.N; j++ {
 					err := f.Document.ValidateInput(test.Input)
-					if test.ErrorsFail(b, err) {
-						return
+					if err != nil {
+						b.Fatal(err)
 					}
 				}
 			})
@@ -165,16 +1026,37 @@ func BenchmarkFixtures(b *testing.B) {
 				var errs []ContextError
 				for j := 0; j < b.N; j++ {
 					out, errs = f.Document.Render(test.Input)
-					if test.ErrorsFail(b, errs) {
-						return
+					if len(errs) > 0 {
+						b.Fatal(errs)
+					}
+				}
+			})
+			b.Run(fmt.Sprintf("Compile-%s-%d-%s", f.Name, i, test.Name), func(b *testing.B) {
+				for j := 0; j < b.N; j++ {
+					_, errs := f.Document.Compile()
+					if len(errs) > 0 {
+						b.Fatal(errs)
+					}
+				}
+			})
+			b.Run(fmt.Sprintf("RenderCompiled-%s-%d-%s", f.Name, i, test.Name), func(b *testing.B) {
+				program, errs := f.Document.Compile()
+				if len(errs) > 0 {
+					b.Fatal(errs)
+				}
+				b.ResetTimer()
+				for j := 0; j < b.N; j++ {
+					_, errs := program.Render(test.Input)
+					if len(errs) > 0 {
+						b.Fatal(errs)
 					}
 				}
 			})
 			b.Run(fmt.Sprintf("CheckOutput-%s-%d-%s", f.Name, i, test.Name), func(b *testing.B) {
 				for j := 0; j < b.N; j++ {
 					err := f.Document.ValidateOutput(out)
-					if test.ErrorsFail(b, err) {
-						return
+					if err != nil {
+						b.Fatal(err)
 					}
 				}
 			})
@@ -0,0 +1,143 @@
+package sdt
+
+import (
+	gocontext "context"
+	"fmt"
+)
+
+// Kinds of errors returned when rendering is stopped early. Use `errors.Is` on
+// the returned `ContextError` values to check for them.
+var (
+	// ErrCanceled is returned when the render's context is canceled or its
+	// deadline is exceeded.
+	ErrCanceled = newErrorKind("canceled", "render canceled")
+
+	// ErrMaxDepth is returned when the template is nested too deeply, e.g.
+	// via recursive definitions.
+	ErrMaxDepth = newErrorKind("max_depth", "maximum render depth exceeded")
+
+	// ErrMaxLoopIterations is returned when the total number of `$for` loop
+	// iterations is too large.
+	ErrMaxLoopIterations = newErrorKind("max_loop_iterations", "maximum loop iterations exceeded")
+
+	// ErrMaxNodes is returned when too many values have been rendered.
+	ErrMaxNodes = newErrorKind("max_nodes", "maximum rendered nodes exceeded")
+
+	// ErrMaxStringLength is returned when an interpolated string is too long.
+	ErrMaxStringLength = newErrorKind("max_string_length", "maximum string length exceeded")
+)
+
+// RenderOptions configures how templates are rendered, including limits used
+// to safely render templates from semi-trusted sources. A zero value for any
+// limit means no limit.
+type RenderOptions struct {
+	// PreserveOrder keeps the key order of objects from the template in the
+	// output by returning `*OrderedMap` values in place of maps. Dynamic keys,
+	// e.g. from `$for` loops, are kept in the order they were generated.
+	PreserveOrder bool
+
+	// SourceMap, if set, is filled in with the template location of each value
+	// in the output, e.g. for use with `Document.ValidateOutputSources`.
+	SourceMap *SourceMap
+
+	// MaxDepth is the maximum nesting depth while rendering, including the
+	// nesting of definitions and includes.
+	MaxDepth int
+
+	// MaxLoopIterations is the maximum total number of items iterated over by
+	// all `$for` loops combined.
+	MaxLoopIterations int
+
+	// MaxNodes is the maximum total number of template values rendered, which
+	// limits the size of the output.
+	MaxNodes int
+
+	// MaxStringLength is the maximum length of any interpolated string.
+	MaxStringLength int
+}
+
+// renderLimits tracks the state of a single render call to enforce its
+// options and cancellation.
+type renderLimits struct {
+	ctx        gocontext.Context
+	opts       RenderOptions
+	depth      int
+	iterations int
+	nodes      int
+
+	// stopped is set once a limit has been exceeded, so that rendering stops
+	// without reporting more errors.
+	stopped bool
+}
+
+func newRenderLimits(ctx gocontext.Context, opts *RenderOptions) *renderLimits {
+	l := &renderLimits{ctx: ctx}
+	if opts != nil {
+		l.opts = *opts
+	}
+	return l
+}
+
+// fail reports an error for a limit and stops rendering.
+func (l *renderLimits) fail(ctx *context, err error, detail interface{}) {
+	l.stopped = true
+	ctx.AddError(fmt.Errorf("error rendering: %w: %v", err, detail))
+}
+
+// enter is called before rendering a value and returns whether rendering
+// should continue. If it returns true, then `exit` must be called after.
+func (l *renderLimits) enter(ctx *context) bool {
+	if l.stopped {
+		return false
+	}
+
+	if err := l.ctx.Err(); err != nil {
+		l.fail(ctx, ErrCanceled, err)
+		return false
+	}
+
+	if l.opts.MaxDepth > 0 && l.depth >= l.opts.MaxDepth {
+		l.fail(ctx, ErrMaxDepth, fmt.Sprintf("limit is %d", l.opts.MaxDepth))
+		return false
+	}
+
+	l.nodes++
+	if l.opts.MaxNodes > 0 && l.nodes > l.opts.MaxNodes {
+		l.fail(ctx, ErrMaxNodes, fmt.Sprintf("limit is %d", l.opts.MaxNodes))
+		return false
+	}
+
+	l.depth++
+	return true
+}
+
+func (l *renderLimits) exit() {
+	l.depth--
+}
+
+// iterate is called before a loop over the given number of items and returns
+// whether rendering should continue.
+func (l *renderLimits) iterate(ctx *context, count int) bool {
+	if l == nil {
+		return true
+	}
+	l.iterations += count
+	if l.opts.MaxLoopIterations > 0 && l.iterations > l.opts.MaxLoopIterations {
+		l.fail(ctx, ErrMaxLoopIterations, fmt.Sprintf("limit is %d", l.opts.MaxLoopIterations))
+		return false
+	}
+	return true
+}
+
+// checkString is called as interpolated strings grow and returns whether
+// rendering should continue.
+func (l *renderLimits) checkString(ctx *context, length int) bool {
+	if l == nil {
+		return true
+	}
+	if l.opts.MaxStringLength > 0 && length > l.opts.MaxStringLength {
+		l.fail(ctx, ErrMaxStringLength, fmt.Sprintf("limit is %d", l.opts.MaxStringLength))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,246 @@
+package sdt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/goccy/go-yaml/ast"
+	"gopkg.in/yaml.v3"
+)
+
+// OrderedMap is an object whose keys are marshalled to JSON or YAML in a
+// specific order. Rendering with the `PreserveOrder` option returns these in
+// place of `map[string]interface{}` so the output keeps the key order of the
+// template.
+type OrderedMap struct {
+	Keys   []string
+	Values map[string]interface{}
+}
+
+// MarshalJSON writes the object's properties in order.
+func (m *OrderedMap) MarshalJSON() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, k := range m.Keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(m.Values[k])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// MarshalYAML returns a mapping node with the object's properties in order.
+func (m *OrderedMap) MarshalYAML() (interface{}, error) {
+	node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for _, k := range m.Keys {
+		key := &yaml.Node{}
+		if err := key.Encode(k); err != nil {
+			return nil, err
+		}
+		value := &yaml.Node{}
+		if err := value.Encode(m.Values[k]); err != nil {
+			return nil, err
+		}
+		node.Content = append(node.Content, key, value)
+	}
+	return node, nil
+}
+
+// plainValue converts any ordered maps within the value back into
+// `map[string]interface{}`, e.g. for schema validation.
+func plainValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case *OrderedMap:
+		tmp := make(map[string]interface{}, len(t.Values))
+		for k, v := range t.Values {
+			tmp[k] = plainValue(v)
+		}
+		return tmp
+	case map[string]interface{}:
+		tmp := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			tmp[k] = plainValue(v)
+		}
+		return tmp
+	case []interface{}:
+		tmp := make([]interface{}, len(t))
+		for i, item := range t {
+			tmp[i] = plainValue(item)
+		}
+		return tmp
+	}
+	return v
+}
+
+// loadKeyOrder walks the parsed document and returns the order of keys for
+// each object within it, by JSON Pointer path. Aliases are followed so that
+// aliased objects keep the key order of their anchored source.
+func loadKeyOrder(file *ast.File) map[string][]string {
+	order := map[string][]string{}
+	anchors := map[string]ast.Node{}
+
+	// resolve skips over anchors and tags and returns the node an alias
+	// refers to. Anchors are recorded as they are found, which is always
+	// before any alias that uses them.
+	var resolve func(n ast.Node) ast.Node
+	resolve = func(n ast.Node) ast.Node {
+		switch t := n.(type) {
+		case *ast.AnchorNode:
+			anchors[t.Name.GetToken().Value] = t.Value
+			return resolve(t.Value)
+		case *ast.TagNode:
+			return resolve(t.Value)
+		case *ast.AliasNode:
+			if target, ok := anchors[t.Value.GetToken().Value]; ok {
+				return resolve(target)
+			}
+		}
+		return n
+	}
+
+	var walk func(path string, n ast.Node)
+	walk = func(path string, n ast.Node) {
+		switch t := resolve(n).(type) {
+		case *ast.MappingNode:
+			keys := make([]string, 0, len(t.Values))
+			for _, item := range t.Values {
+				k := resolve(item.Key)
+				if mk, ok := k.(*ast.MappingKeyNode); ok {
+					k = resolve(mk.Value)
+				}
+				key := k.GetToken().Value
+				keys = append(keys, key)
+				walk(path+"/"+key, item.Value)
+			}
+			if path == "" {
+				path = "/"
+			}
+			order[path] = keys
+		case *ast.MappingValueNode:
+			// A single key-value pair is parsed without a surrounding mapping.
+			walk(path, ast.Mapping(t.Start, false, t))
+		case *ast.SequenceNode:
+			for i, child := range t.Values {
+				walk(fmt.Sprintf("%s/%d", path, i), child)
+			}
+		}
+	}
+	for _, doc := range file.Docs {
+		walk("", doc.Body)
+	}
+
+	return order
+}
+
+// templateKeys returns the keys of an object in the template in the order
+// they were written in the document source.
+func (doc *Document) templateKeys(path string, m map[string]interface{}) []string {
+	return orderedKeys(doc.keyOrder[path], m)
+}
+
+// orderedKeys returns the keys of the object in the given order. Any keys
+// not in the order are sorted and placed at the end.
+func orderedKeys(order []string, m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	seen := make(map[string]bool, len(m))
+	for _, k := range order {
+		if _, ok := m[k]; ok && !seen[k] {
+			keys = append(keys, k)
+			seen[k] = true
+		}
+	}
+	if len(keys) < len(m) {
+		for _, k := range sortedKeys(m) {
+			if !seen[k] {
+				keys = append(keys, k)
+			}
+		}
+	}
+	return keys
+}
+
+// keyOrder records the key order of objects created while rendering, so
+// that the output can keep the order of the template.
+type keyOrder struct {
+	keys map[uintptr][]string
+
+	// objects keeps each recorded object alive until the render is complete
+	// so that its address is not reused by another object.
+	objects []map[string]interface{}
+}
+
+func newKeyOrder() *keyOrder {
+	return &keyOrder{keys: map[uintptr][]string{}}
+}
+
+// set records the order of keys for an object. Safe to call on nil, which
+// does nothing.
+func (o *keyOrder) set(m map[string]interface{}, keys []string) {
+	if o == nil {
+		return
+	}
+	o.keys[reflect.ValueOf(m).Pointer()] = keys
+	o.objects = append(o.objects, m)
+}
+
+// setTemplate records the order of keys for a value used as-is from the
+// template at the given path, e.g. via `$literal`. Safe to call on nil.
+func (o *keyOrder) setTemplate(doc *Document, path string, v interface{}) {
+	if o == nil {
+		return
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		o.set(t, doc.templateKeys(path, t))
+		for k, v := range t {
+			o.setTemplate(doc, path+"/"+k, v)
+		}
+	case []interface{}:
+		for i, item := range t {
+			o.setTemplate(doc, fmt.Sprintf("%s/%d", path, i), item)
+		}
+	}
+}
+
+// get returns the keys of an object in their recorded order. Any keys
+// without a recorded order are sorted and placed at the end.
+func (o *keyOrder) get(m map[string]interface{}) []string {
+	return orderedKeys(o.keys[reflect.ValueOf(m).Pointer()], m)
+}
+
+// apply converts the rendered output into a new value where every object is
+// an `*OrderedMap` using its recorded key order.
+func (o *keyOrder) apply(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		ordered := &OrderedMap{
+			Keys:   o.get(t),
+			Values: make(map[string]interface{}, len(t)),
+		}
+		for k, v := range t {
+			ordered.Values[k] = o.apply(v)
+		}
+		return ordered
+	case []interface{}:
+		tmp := make([]interface{}, len(t))
+		for i, item := range t {
+			tmp[i] = o.apply(item)
+		}
+		return tmp
+	}
+	return v
+}
@@ -0,0 +1,452 @@
+package sdt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/goccy/go-yaml/ast"
+	"github.com/goccy/go-yaml/parser"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"gopkg.in/yaml.v3"
+)
+
+// Params are input params loaded from a JSON or YAML source. The source is
+// kept so that validation errors can point to the location of bad values.
+type Params struct {
+	// Filename used when reporting errors.
+	Filename string
+
+	// Values are the params to pass when rendering. Numbers are stored as
+	// `json.Number` so that no precision is lost before rendering.
+	Values map[string]interface{}
+
+	ast *ast.File
+
+	// overrides are other params merged on top of these ones, used to report
+	// errors against the source of each value.
+	overrides []*Params
+}
+
+// Merge deeply assigns the values from other params on top of these ones,
+// e.g. to override params from a file with command line arguments. Objects
+// are merged while any other values are replaced. Errors from
+// `Document.ValidateParams` for values which came from the other params are
+// reported against its filename and source.
+func (p *Params) Merge(other *Params) {
+	if p.Values == nil {
+		p.Values = map[string]interface{}{}
+	}
+	deepAssign(p.Values, other.Values)
+	p.overrides = append(p.overrides, other)
+}
+
+// deepAssign recursively merges objects from the source into the target,
+// replacing any other values.
+func deepAssign(target, source map[string]interface{}) {
+	for k, v := range source {
+		if sm, ok := v.(map[string]interface{}); ok {
+			if tm, ok := target[k].(map[string]interface{}); ok {
+				deepAssign(tm, sm)
+				continue
+			}
+			v = copyMap(sm)
+		}
+		target[k] = v
+	}
+}
+
+// source returns the params which provided the value at the JSON Pointer
+// path, taking into account any merged overrides.
+func (p *Params) source(path string) *Params {
+	for i := len(p.overrides) - 1; i >= 0; i-- {
+		if p.overrides[i].provides(path) {
+			return p.overrides[i].source(path)
+		}
+	}
+	return p
+}
+
+// provides returns whether these params set the value at the JSON Pointer
+// path, either directly or by setting one of its parents to a non-object.
+func (p *Params) provides(path string) bool {
+	var v interface{} = p.Values
+	if path == "" || path == "/" {
+		return false
+	}
+	for _, part := range strings.Split(strings.TrimPrefix(path, "/"), "/") {
+		part = strings.NewReplacer("~1", "/", "~0", "~").Replace(part)
+		switch t := v.(type) {
+		case map[string]interface{}:
+			item, ok := t[part]
+			if !ok {
+				return false
+			}
+			v = item
+		default:
+			// A parent was replaced by a value which can't contain the path.
+			return true
+		}
+	}
+	return true
+}
+
+// ParseParams parses JSON or YAML params, keeping the source so that errors
+// from `Document.ValidateParams` include line and column information.
+func ParseParams(filename string, data []byte) (*Params, error) {
+	params := &Params{
+		Filename: filename,
+		Values:   map[string]interface{}{},
+	}
+
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+
+	if len(node.Content) > 0 {
+		v, err := nodeValue(node.Content[0])
+		if err != nil {
+			return nil, err
+		}
+		switch m := v.(type) {
+		case nil:
+			// Empty document, e.g. only comments.
+		case map[string]interface{}:
+			params.Values = m
+		default:
+			return nil, fmt.Errorf("params must be an object")
+		}
+	}
+
+	astFile, err := parser.ParseBytes(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	params.ast = astFile
+
+	return params, nil
+}
+
+// jsonNumberRegex matches numbers which are written the same in YAML and JSON.
+var jsonNumberRegex = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// nodeValue converts a YAML node into a value, using `json.Number` for any
+// numbers.
+func nodeValue(n *yaml.Node) (interface{}, error) {
+	switch n.Kind {
+	case yaml.AliasNode:
+		return nodeValue(n.Alias)
+	case yaml.MappingNode:
+		m := map[string]interface{}{}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			if k.ShortTag() == "!!merge" {
+				// Merge keys are handled by the decoder, so fall back to it.
+				var tmp interface{}
+				err := n.Decode(&tmp)
+				return tmp, err
+			}
+			value, err := nodeValue(v)
+			if err != nil {
+				return nil, err
+			}
+			m[k.Value] = value
+		}
+		return m, nil
+	case yaml.SequenceNode:
+		s := make([]interface{}, 0, len(n.Content))
+		for _, item := range n.Content {
+			value, err := nodeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			s = append(s, value)
+		}
+		return s, nil
+	}
+
+	tag := n.ShortTag()
+	if (tag == "!!int" || tag == "!!float") && jsonNumberRegex.MatchString(n.Value) {
+		return json.Number(n.Value), nil
+	}
+
+	var v interface{}
+	err := n.Decode(&v)
+	return v, err
+}
+
+// ValidateParams validates params against the input schema. Unlike
+// `ValidateInput`, an error is returned for each invalid value, positioned
+// within the params source.
+func (doc *Document) ValidateParams(params *Params) []ContextError {
+	if doc.Schemas == nil || doc.Schemas.Input == nil {
+		return nil
+	}
+
+	if err := doc.LoadSchemas(); err != nil {
+		ctx := newContext(doc, "schemas", "input")
+		ctx.AddError(err)
+		return ctx.Meta.Errors
+	}
+	if doc.inputSchema == nil {
+		ctx := newContext(doc, "schemas", "input")
+		ctx.AddError(ErrInvalidSchema.errorf("input schema could not be loaded"))
+		return ctx.Meta.Errors
+	}
+
+	err := doc.inputSchema.Validate(params.Values)
+	if err == nil {
+		return nil
+	}
+
+	ctx := &context{
+		Filename: params.Filename,
+		Path:     "/",
+		Meta:     &contextMeta{},
+		AST:      params.ast,
+		Doc:      doc,
+	}
+
+	problems, ok := schemaProblems(err, doc.inputSchema, params.Values)
+	if !ok {
+		ctx.AddError(ErrInvalidInput.errorf("error validating params against schema: %w", err))
+		return ctx.Meta.Errors
+	}
+
+	for _, p := range problems {
+		path := p.location
+		if p.property != "" {
+			path += "/" + escapePointer(p.property)
+		}
+		source := params.source(path)
+
+		causeCtx := *ctx
+		causeCtx.Filename = source.Filename
+		causeCtx.AST = source.ast
+		causeCtx.Path = "/" + strings.TrimPrefix(p.location, "/")
+
+		if p.property != "" {
+			causeCtx.WithPath(escapePointer(p.property)).AddError(ErrUnknownProperty.errorf("error validating params: property %s is not allowed%s", p.property, propertySuggestion(doc.inputSchema, p)))
+			continue
+		}
+
+		causeCtx.AddError(ErrInvalidInput.errorf("error validating params: %s", p.message))
+	}
+
+	return ctx.Meta.Errors
+}
+
+// schemaProblem is a single problem found when validating a value against a
+// schema.
+type schemaProblem struct {
+	// location is the JSON Pointer path to the invalid value.
+	location string
+	message  string
+
+	// property is set when a property is not allowed, in which case the
+	// location is that of the object containing it.
+	property string
+}
+
+// schemaProblems returns the individual problems described by a schema
+// validation error of the value, including nested causes, sorted by location.
+// Returns false if the error is not a validation error.
+func schemaProblems(err error, s *jsonschema.Schema, value interface{}) ([]schemaProblem, bool) {
+	var verr *jsonschema.ValidationError
+	if !errors.As(err, &verr) {
+		return nil, false
+	}
+
+	problems := []schemaProblem{}
+	for _, cause := range leafCauses(verr) {
+		location := pointer(pointerTokens(cause.InstanceLocation))
+		if strings.HasSuffix(cause.KeywordLocation, "/additionalProperties") {
+			// Report each of the unexpected properties rather than the object
+			// which contains them.
+			parent := keywordSchema(s, strings.TrimSuffix(cause.KeywordLocation, "/additionalProperties"))
+			object, isObject := valueAt(value, location).(map[string]interface{})
+			if parent != nil && isObject {
+				for _, name := range extraProperties(parent, object) {
+					problems = append(problems, schemaProblem{location: location, property: name})
+				}
+				continue
+			}
+		}
+		problems = append(problems, schemaProblem{location: location, message: cause.Message})
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].location < problems[j].location
+	})
+
+	return problems, true
+}
+
+// propertySuggestion returns a suggestion for an unknown property based on
+// the properties allowed at its location by the schema.
+func propertySuggestion(s *jsonschema.Schema, p schemaProblem) string {
+	return didYouMean(p.property, getKeys(schemaAt(s, p.location).Properties))
+}
+
+// schemaAt returns the schema which describes the value at the JSON Pointer
+// location within a value of the given schema.
+func schemaAt(s *jsonschema.Schema, location string) *jsonschema.Schema {
+	for s.Ref != nil {
+		s = s.Ref
+	}
+	if location == "" || location == "/" {
+		return s
+	}
+	for _, part := range strings.Split(strings.TrimPrefix(location, "/"), "/") {
+		part = strings.NewReplacer("~1", "/", "~0", "~").Replace(part)
+		if hasType(s, "array") {
+			s = getItems(s)
+		} else {
+			s = getPropertySchema(s, part)
+		}
+		for s.Ref != nil {
+			s = s.Ref
+		}
+	}
+	return s
+}
+
+// pointerTokens returns the unescaped tokens of a JSON Pointer from a schema
+// validation error, which are also percent-encoded.
+func pointerTokens(location string) []string {
+	if unescaped, err := url.PathUnescape(location); err == nil {
+		location = unescaped
+	}
+	location = strings.TrimPrefix(location, "/")
+	if location == "" {
+		return nil
+	}
+	tokens := strings.Split(location, "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens
+}
+
+// pointer returns the JSON Pointer for the given unescaped tokens.
+func pointer(tokens []string) string {
+	p := ""
+	for _, token := range tokens {
+		p += "/" + escapePointer(token)
+	}
+	return p
+}
+
+// keywordSchema returns the schema at the keyword location of a validation
+// error, like `/properties/tags/$ref/items`, or nil if it can't be found.
+func keywordSchema(s *jsonschema.Schema, location string) *jsonschema.Schema {
+	tokens := pointerTokens(location)
+
+	// index returns the schema at the next token's index within the list.
+	index := func(i int, list []*jsonschema.Schema) *jsonschema.Schema {
+		if i >= len(tokens) {
+			return nil
+		}
+		n, err := strconv.Atoi(tokens[i])
+		if err != nil || n < 0 || n >= len(list) {
+			return nil
+		}
+		return list[n]
+	}
+
+	for i := 0; i < len(tokens) && s != nil; i++ {
+		switch tokens[i] {
+		case "$ref":
+			s = s.Ref
+		case "properties":
+			i++
+			if i >= len(tokens) {
+				return nil
+			}
+			s = s.Properties[tokens[i]]
+		case "patternProperties":
+			i++
+			var match *jsonschema.Schema
+			for re, prop := range s.PatternProperties {
+				if i < len(tokens) && re.String() == tokens[i] {
+					match = prop
+				}
+			}
+			s = match
+		case "additionalProperties":
+			s, _ = s.AdditionalProperties.(*jsonschema.Schema)
+		case "items":
+			switch items := s.Items.(type) {
+			case *jsonschema.Schema:
+				s = items
+			case []*jsonschema.Schema:
+				i++
+				s = index(i, items)
+			default:
+				s = s.Items2020
+			}
+		case "prefixItems":
+			i++
+			s = index(i, s.PrefixItems)
+		case "allOf":
+			i++
+			s = index(i, s.AllOf)
+		case "anyOf":
+			i++
+			s = index(i, s.AnyOf)
+		case "oneOf":
+			i++
+			s = index(i, s.OneOf)
+		case "not":
+			s = s.Not
+		case "if":
+			s = s.If
+		case "then":
+			s = s.Then
+		case "else":
+			s = s.Else
+		default:
+			return nil
+		}
+	}
+	return s
+}
+
+// extraProperties returns the sorted names of an object's properties which
+// are not described by the schema's properties or pattern properties.
+func extraProperties(s *jsonschema.Schema, object map[string]interface{}) []string {
+	names := []string{}
+outer:
+	for _, name := range sortedKeys(object) {
+		if s.Properties[name] != nil {
+			continue
+		}
+		for re := range s.PatternProperties {
+			if re.MatchString(name) {
+				continue outer
+			}
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// leafCauses returns the most specific causes of a validation error, which
+// describe the actual problems with the input.
+func leafCauses(err *jsonschema.ValidationError) []*jsonschema.ValidationError {
+	if len(err.Causes) == 0 {
+		return []*jsonschema.ValidationError{err}
+	}
+
+	causes := []*jsonschema.ValidationError{}
+	for _, cause := range err.Causes {
+		causes = append(causes, leafCauses(cause)...)
+	}
+	return causes
+}
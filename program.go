@@ -0,0 +1,213 @@
+package sdt
+
+import (
+	gocontext "context"
+	"reflect"
+	"strings"
+
+	"github.com/danielgtaylor/mexpr"
+)
+
+// Program is a compiled document which can be rendered many times without
+// re-scanning the template's strings, re-parsing its expressions, or
+// re-resolving its operators. Create one via `Document.Compile()`.
+type Program struct {
+	doc *Document
+
+	// strings holds the compiled version of every string within the document
+	// and its definitions and includes, keyed by the original string.
+	strings map[string]*compiledString
+
+	// operators holds the resolved operator of every object within the
+	// document and its definitions and includes, keyed by the object's
+	// identity since equal objects may resolve differently in different
+	// documents.
+	operators map[uintptr]*compiledOperator
+}
+
+// compiledOperator is a template object whose operator, and the definition or
+// document it refers to, has been resolved ahead of time.
+type compiledOperator struct {
+	// name is the operator, e.g. `$if`, or empty for a plain object.
+	name string
+
+	// def is the definition used by `$ref` or `$call` and included is the
+	// document loaded by `$include`. Either is nil if it could not be found,
+	// in which case rendering reports the error.
+	def      *definition
+	included *Document
+}
+
+// compiledString is a template string which has been scanned for `${...}`
+// expressions ahead of time.
+type compiledString struct {
+	matches [][]int
+
+	// asts holds the parsed expression for each match. An entry is nil if the
+	// expression can't be safely reused and must be parsed on each render.
+	asts []*mexpr.Node
+}
+
+// Compile walks the document's template, definitions, and includes once to
+// scan all strings, parse all expressions, and resolve the operator of each
+// object along with the definition or include it refers to, returning a
+// program which can be rendered repeatedly. Errors are returned for invalid
+// expressions and includes which cannot be loaded or form a cycle.
+func (doc *Document) Compile() (*Program, []ContextError) {
+	doc.LoadSchemas()
+
+	p := &Program{
+		doc:       doc,
+		strings:   map[string]*compiledString{},
+		operators: map[uintptr]*compiledOperator{},
+	}
+
+	ctx := newContext(doc, "template")
+	p.compileDocument(ctx, doc, map[*Document]bool{})
+
+	return p, ctx.Meta.Errors
+}
+
+// Render the compiled template into a data structure. This behaves the same
+// as `Document.Render` but is faster.
+func (p *Program) Render(params map[string]interface{}) (interface{}, []ContextError) {
+	return p.doc.render(gocontext.Background(), p, params, nil)
+}
+
+// RenderContext renders the compiled template into a data structure. This
+// behaves the same as `Document.RenderContext` but is faster.
+func (p *Program) RenderContext(ctx gocontext.Context, params map[string]interface{}, opts *RenderOptions) (interface{}, []ContextError) {
+	return p.doc.render(ctx, p, params, opts)
+}
+
+// lookup returns the compiled version of a string, if available. It is safe
+// to call on a nil program.
+func (p *Program) lookup(s string) *compiledString {
+	if p == nil {
+		return nil
+	}
+	return p.strings[s]
+}
+
+// operator returns the operator of a template object, resolved when compiling
+// if available. It is safe to call on a nil program.
+func (p *Program) operator(v map[string]interface{}) compiledOperator {
+	if p != nil {
+		if op := p.operators[reflect.ValueOf(v).Pointer()]; op != nil {
+			return *op
+		}
+	}
+	name, _ := findOperator(v)
+	return compiledOperator{name: name}
+}
+
+// compileDocument compiles a document's template and definitions, following
+// any static includes.
+func (p *Program) compileDocument(ctx *context, doc *Document, visited map[*Document]bool) {
+	if visited[doc] {
+		return
+	}
+	visited[doc] = true
+
+	p.compileTemplate(ctx, doc.Template, visited)
+
+	for _, name := range sortedKeys(doc.Definitions) {
+		if def, ok := doc.getDefinition(name); ok {
+			defCtx := *ctx
+			defCtx.Path = def.Path
+			p.compileTemplate(&defCtx, def.Template, visited)
+		}
+	}
+}
+
+func (p *Program) compileTemplate(ctx *context, template interface{}, visited map[*Document]bool) {
+	switch t := template.(type) {
+	case map[string]interface{}:
+		name, _ := findOperator(t)
+		op := &compiledOperator{name: name}
+		p.operators[reflect.ValueOf(t).Pointer()] = op
+
+		switch name {
+		case "$literal":
+			// Literal values are output as-is, so there is nothing to compile.
+			return
+		case "$ref":
+			ref, _ := refName(t["$ref"])
+			op.def, _ = ctx.Doc.getDefinition(ref)
+		case "$call":
+			if ref, ok := t["$call"].(string); ok {
+				op.def, _ = ctx.Doc.getDefinition(ref)
+			}
+		case "$include":
+			if filename, ok := t["$include"].(string); ok {
+				included, err := ctx.Doc.loadInclude(filename)
+				if err != nil {
+					ctx.WithPath("$include").AddError(ErrInclude.errorf("error compiling: unable to include %s: %w", filename, err))
+					return
+				}
+				if cycle := ctx.IncludeCycle(included); cycle != nil {
+					ctx.WithPath("$include").AddError(ErrIncludeCycle.errorf("error compiling: include cycle detected: %s", strings.Join(cycle, " -> ")))
+					return
+				}
+				op.included = included
+				p.compileDocument(ctx.WithInclude(included), included, visited)
+				return
+			}
+		}
+
+		for _, k := range sortedKeys(t) {
+			p.compileString(ctx.WithPath(k), k)
+			p.compileTemplate(ctx.WithPath(k), t[k], visited)
+		}
+	case []interface{}:
+		for i, item := range t {
+			p.compileTemplate(ctx.WithPath(i), item, visited)
+		}
+	case string:
+		p.compileString(ctx, t)
+	}
+}
+
+func (p *Program) compileString(ctx *context, s string) {
+	if _, ok := p.strings[s]; ok {
+		return
+	}
+
+	matches, scanErr := findInterpolations(s)
+	if scanErr != nil {
+		// Not cached, so the error is also returned when rendering.
+		ctx.AddErrorOffset(ErrExprCompile.errorf("error compiling: %w", scanErr), scanErr.Offset(), scanErr.Length())
+		return
+	}
+
+	compiled := &compiledString{
+		matches: matches,
+		asts:    make([]*mexpr.Node, len(matches)),
+	}
+
+	for i, match := range matches {
+		ast, err := mexpr.Parse(s[match[0]+2:match[1]-1], nil)
+		if err != nil {
+			ctx.AddErrorOffset(ErrExprCompile.errorf("error compiling: %v", err), uint16(match[0])+err.Offset()+2, err.Length())
+			continue
+		}
+		if !hasSlice(ast) {
+			compiled.asts[i] = ast
+		}
+	}
+
+	p.strings[s] = compiled
+}
+
+// hasSlice returns whether the expression contains a slice operation. The
+// interpreter stores slice results in the AST itself, so these expressions
+// can't be shared between renders.
+func hasSlice(ast *mexpr.Node) bool {
+	if ast == nil {
+		return false
+	}
+	if ast.Type == mexpr.NodeSlice {
+		return true
+	}
+	return hasSlice(ast.Left) || hasSlice(ast.Right)
+}
@@ -1,21 +1,179 @@
 package sdt
 
 import (
+	"encoding/json"
 	"fmt"
-	"regexp"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/danielgtaylor/mexpr"
 )
 
-// This is the regex used to find/replace ${...} expressions within strings.
-var interpolationRe = regexp.MustCompile(`[$][{].*?[}]`)
+// scanError describes an expression within a string which was started with
+// `${` but never terminated.
+type scanError struct {
+	offset int
+	length int
+}
+
+func (e *scanError) Error() string {
+	return "unterminated expression, expected '}'"
+}
+
+// Offset returns the position of the unterminated expression in the string.
+func (e *scanError) Offset() uint16 {
+	return uint16(e.offset)
+}
+
+// Length returns the length of the unterminated expression, capped to fit in
+// an error marker.
+func (e *scanError) Length() uint8 {
+	if e.length > 255 {
+		return 255
+	}
+	return uint8(e.length)
+}
+
+// findInterpolations returns the start and end index of each `${...}`
+// expression within a string, skipping any escaped `$${` sequences. Braces
+// and double-quoted strings within an expression are tracked so that a `}`
+// only ends the expression when it is not nested or quoted.
+func findInterpolations(s string) ([][]int, *scanError) {
+	matches := [][]int{}
+
+	for i := 0; i < len(s)-1; i++ {
+		if s[i] != '$' || s[i+1] != '{' {
+			continue
+		}
+
+		if escapedDollars(s, i)%2 == 1 {
+			// Escaped `$${`, which is output as a literal `${`.
+			i++
+			continue
+		}
+
+		start := i
+		depth := 0
+		quoted := false
+		end := -1
+
+	scan:
+		for i += 2; i < len(s); i++ {
+			switch c := s[i]; {
+			case quoted:
+				if c == '\\' && i+1 < len(s) && s[i+1] == '"' {
+					i++
+				} else if c == '"' {
+					quoted = false
+				}
+			case c == '"':
+				quoted = true
+			case c == '{':
+				depth++
+			case c == '}':
+				if depth == 0 {
+					end = i + 1
+					break scan
+				}
+				depth--
+			}
+		}
+
+		if end == -1 {
+			return nil, &scanError{offset: start, length: len(s) - start}
+		}
+
+		matches = append(matches, []int{start, end})
+		i = end - 1
+	}
+
+	return matches, nil
+}
+
+// isFullInterpolation returns whether the string is exactly one `${...}`
+// expression, which can result in any type rather than just a string.
+func isFullInterpolation(s string, matches [][]int) bool {
+	return len(matches) == 1 && matches[0][0] == 0 && matches[0][1] == len(s)
+}
+
+// escapedDollars returns the number of `$` characters directly before the
+// given index.
+func escapedDollars(s string, i int) int {
+	n := 0
+	for i-n > 0 && s[i-n-1] == '$' {
+		n++
+	}
+	return n
+}
+
+// unescape replaces escaped `$${` sequences with a literal `${`. Each `$$`
+// before a `${` is output as a single `$`, so `$$${x}` is a literal `$`
+// followed by an expression. Set `beforeMatch` if the string is directly
+// followed by an expression.
+func unescape(s string, beforeMatch bool) string {
+	if !strings.Contains(s, "$") {
+		return s
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' {
+			sb.WriteByte(s[i])
+			continue
+		}
+
+		// Find the end of this run of `$` characters.
+		end := i
+		for end < len(s) && s[end] == '$' {
+			end++
+		}
+		run := end - i
+		if (end < len(s) && s[end] == '{') || (end == len(s) && beforeMatch) {
+			run = (run + 1) / 2
+		}
+		sb.WriteString(strings.Repeat("$", run))
+		i = end - 1
+	}
+	return sb.String()
+}
+
+// unescapeKey returns the literal name of an object key, where `$$` at the
+// start of a key is used to escape names like `$if` which would otherwise be
+// treated as an operator.
+func unescapeKey(k string) string {
+	if strings.HasPrefix(k, "$$") {
+		return k[1:]
+	}
+	return k
+}
+
+// definitionsPrefix is the prefix of `$ref` values that point to a definition
+// within the current document.
+const definitionsPrefix = "#/definitions/"
+
+// maxRefDepth limits how deeply definitions can be nested when rendering to
+// prevent infinite recursion.
+const maxRefDepth = 64
+
+// refName returns the name of the definition referenced by a `$ref` value.
+// Other references, e.g. to JSON Schemas, are not definitions and should be
+// rendered as-is.
+func refName(ref interface{}) (string, bool) {
+	if s, ok := ref.(string); ok && strings.HasPrefix(s, definitionsPrefix) {
+		return strings.TrimPrefix(s, definitionsPrefix), true
+	}
+	return "", false
+}
 
 func isZero(v interface{}) bool {
 	switch t := v.(type) {
 	case bool:
 		return !t
-	case int, int8, int16, int32, uint, uint8, uint16, uint32, float32, float64:
-		return t == 0
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, json.Number:
+		f, _ := toFloat(t)
+		return f == 0
 	case string:
 		return len(t) == 0
 	case []byte:
@@ -31,13 +189,40 @@ func isZero(v interface{}) bool {
 func handleBranch(ctx *context, v map[string]interface{}, params map[string]interface{}) interface{} {
 	result := v["$if"]
 	if s, ok := result.(string); ok {
-		result = handleInterpolation(ctx, s, params)
+		result = handleInterpolation(ctx.WithPath("$if"), s, params)
 	}
 
 	if result != nil && !isZero(result) {
-		return render(ctx, v["$then"], params)
+		return render(ctx.WithPath("$then"), v["$then"], params)
 	} else if v["$else"] != nil {
-		return render(ctx, v["$else"], params)
+		return render(ctx.WithPath("$else"), v["$else"], params)
+	}
+	return nil
+}
+
+// switchCase returns the `$case` key used to match a `$switch` value.
+func switchCase(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+func handleSwitch(ctx *context, v map[string]interface{}, params map[string]interface{}) interface{} {
+	value := v["$switch"]
+	if s, ok := value.(string); ok {
+		value = handleInterpolation(ctx.WithPath("$switch"), s, params)
+	}
+
+	if cases, ok := v["$case"].(map[string]interface{}); ok && value != nil {
+		key := switchCase(value)
+		if c, ok := cases[key]; ok {
+			return render(ctx.WithPath("$case").WithPath(key), c, params)
+		}
+	}
+
+	if v["$default"] != nil {
+		return render(ctx.WithPath("$default"), v["$default"], params)
 	}
 	return nil
 }
@@ -53,8 +238,31 @@ func handleLoop(ctx *context, v map[string]interface{}, params map[string]interf
 		return nil
 	}
 
+	if m, ok := items.(map[string]interface{}); ok {
+		items = objectEntries(m)
+	} else if isLoopPair(v["$as"]) {
+		return ctx.WithPath("$as").AddError(ErrInvalidOperator.errorf("error rendering: $as pair can only be used when looping over an object"))
+	}
+
 	if items, ok := items.([]interface{}); ok {
+		if !ctx.Meta.Limits.iterate(ctx.WithPath("$for"), len(items)) {
+			return nil
+		}
+
+		vars := newLoopVars(v["$as"])
+
+		items = filterLoopItems(ctx, v, params, vars, items)
+		if items == nil {
+			return nil
+		}
+
 		tmp := []interface{}{}
+		var origins []*context
+		var keyed map[string]interface{}
+		var keys []string
+		if v["$key"] != nil {
+			keyed = map[string]interface{}{}
+		}
 
 		for i, item := range items {
 			paramsCopy := map[string]interface{}{}
@@ -62,116 +270,943 @@ func handleLoop(ctx *context, v map[string]interface{}, params map[string]interf
 				paramsCopy[k] = v
 			}
 
-			itemName := "item"
-			if v["$as"] != nil {
-				itemName = v["$as"].(string)
-			}
-			paramsCopy[itemName] = item
-
-			loopName := "loop"
-			if itemName != "item" {
-				loopName += "_" + itemName
-			}
-			paramsCopy[loopName] = map[string]interface{}{
+			vars.bind(paramsCopy, item)
+			paramsCopy[vars.loop] = map[string]interface{}{
 				"index": i,
 				"first": i == 0,
 				"last":  i == len(items)-1,
 			}
 
-			itemResult := render(ctx.WithPath(i), v["$each"], paramsCopy)
+			if keyed != nil {
+				key, ok := render(ctx.WithPath("$key"), v["$key"], paramsCopy).(string)
+				if !ok {
+					ctx.WithPath("$key").AddError(ErrTypeMismatch.errorf("error rendering: $key must result in a string"))
+					continue
+				}
+				if _, exists := keyed[key]; exists {
+					ctx.WithPath("$key").AddError(ErrDuplicateKey.errorf("error rendering: duplicate key '%s' in $for output", key))
+					continue
+				}
+				keyed[key] = render(ctx.WithPath("$each"), v["$each"], paramsCopy)
+				keys = append(keys, key)
+				ctx.Meta.Sources.setKey(keyed, key, ctx.Meta.Sources.last())
+				continue
+			}
+
+			itemResult := render(ctx.WithPath("$each"), v["$each"], paramsCopy)
 			tmp = append(tmp, itemResult)
+			if ctx.Meta.Sources != nil {
+				origins = append(origins, ctx.Meta.Sources.last())
+			}
 		}
 
+		ctx.Meta.Sources.setOrigin(ctx)
+
+		if keyed != nil {
+			ctx.Meta.Order.set(keyed, keys)
+			return keyed
+		}
+
+		ctx.Meta.Sources.setItems(tmp, origins)
 		return tmp
 	}
 
-	return ctx.AddError(fmt.Errorf("error rendering: $for expression result is not iterable: %v", items))
+	return ctx.AddError(ErrNotIterable.errorf("error rendering: $for expression result is not iterable: %v", items))
+}
+
+// loopVars describes the names of the variables set for each item of a
+// `$for` loop.
+type loopVars struct {
+	// key is the name of the key variable when `$as` is a pair, otherwise
+	// empty.
+	key  string
+	item string
+	loop string
+}
+
+// newLoopVars returns the variable names from a loop's `$as` value, which is
+// either a single name or a `[key, value]` pair when looping over an object.
+func newLoopVars(as interface{}) loopVars {
+	vars := loopVars{item: "item", loop: "loop"}
+
+	switch a := as.(type) {
+	case string:
+		vars.item = a
+		if a != "item" {
+			vars.loop += "_" + a
+		}
+	case []interface{}:
+		if isLoopPair(a) {
+			vars.key = a[0].(string)
+			vars.item = a[1].(string)
+			vars.loop += "_" + vars.key
+		}
+	}
+
+	return vars
+}
+
+// isLoopPair returns whether the `$as` value is a `[key, value]` pair of
+// variable names.
+func isLoopPair(as interface{}) bool {
+	if a, ok := as.([]interface{}); ok && len(a) == 2 {
+		_, ok1 := a[0].(string)
+		_, ok2 := a[1].(string)
+		return ok1 && ok2
+	}
+	return false
+}
+
+// bind sets the loop item variables in the params.
+func (vars loopVars) bind(params map[string]interface{}, item interface{}) {
+	if vars.key != "" {
+		entry, _ := item.(map[string]interface{})
+		params[vars.key] = entry["key"]
+		params[vars.item] = entry["value"]
+		return
+	}
+	params[vars.item] = item
+}
+
+// objectEntries converts an object into a list of `{key, value}` entries
+// sorted by key so that looping over an object is deterministic.
+func objectEntries(m map[string]interface{}) []interface{} {
+	entries := make([]interface{}, 0, len(m))
+	for _, k := range sortedKeys(m) {
+		entries = append(entries, map[string]interface{}{
+			"key":   k,
+			"value": m[k],
+		})
+	}
+	return entries
+}
+
+// filterLoopItems applies the optional `$where`, `$sortBy`, `$reverse`, and
+// `$limit` clauses of a `$for` loop, in that order, returning a new list of
+// items to render. Returns nil if an error was encountered.
+func filterLoopItems(ctx *context, v map[string]interface{}, params map[string]interface{}, vars loopVars, items []interface{}) []interface{} {
+	if v["$where"] == nil && v["$sortBy"] == nil && v["$reverse"] == nil && v["$limit"] == nil {
+		return items
+	}
+
+	// Each expression only has access to the current item, not the loop
+	// metadata, since filtering and sorting change the index of each item.
+	evalItem := func(path string, item interface{}) (interface{}, bool) {
+		paramsCopy := map[string]interface{}{}
+		for k, param := range params {
+			paramsCopy[k] = param
+		}
+		vars.bind(paramsCopy, item)
+
+		errCount := len(ctx.Meta.Errors)
+		result := render(ctx.WithPath(path), v[path], paramsCopy)
+		return result, len(ctx.Meta.Errors) == errCount
+	}
+
+	filtered := make([]interface{}, 0, len(items))
+	if v["$where"] != nil {
+		for _, item := range items {
+			keep, ok := evalItem("$where", item)
+			if !ok {
+				return nil
+			}
+			if keep != nil && !isZero(keep) {
+				filtered = append(filtered, item)
+			}
+		}
+	} else {
+		filtered = append(filtered, items...)
+	}
+
+	if v["$sortBy"] != nil {
+		keys := make([]interface{}, len(filtered))
+		for i, item := range filtered {
+			key, ok := evalItem("$sortBy", item)
+			if !ok {
+				return nil
+			}
+			if _, ok := sortKeyRank(key); !ok {
+				ctx.WithPath("$sortBy").AddError(ErrTypeMismatch.errorf("error rendering: $sortBy result must be a number, string, or boolean but found '%v'", key))
+				return nil
+			}
+			keys[i] = key
+		}
+
+		indexes := make([]int, len(filtered))
+		for i := range indexes {
+			indexes[i] = i
+		}
+		sort.SliceStable(indexes, func(i, j int) bool {
+			return compareSortKeys(keys[indexes[i]], keys[indexes[j]]) < 0
+		})
+
+		sorted := make([]interface{}, len(filtered))
+		for i, index := range indexes {
+			sorted[i] = filtered[index]
+		}
+		filtered = sorted
+	}
+
+	if v["$reverse"] != nil {
+		reverse := render(ctx.WithPath("$reverse"), v["$reverse"], params)
+		if reverse != nil && !isZero(reverse) {
+			for i, j := 0, len(filtered)-1; i < j; i, j = i+1, j-1 {
+				filtered[i], filtered[j] = filtered[j], filtered[i]
+			}
+		}
+	}
+
+	if v["$limit"] != nil {
+		limit, ok := toInt(render(ctx.WithPath("$limit"), v["$limit"], params))
+		if !ok || limit < 0 {
+			ctx.WithPath("$limit").AddError(ErrTypeMismatch.errorf("error rendering: $limit must be a non-negative integer"))
+			return nil
+		}
+		if limit < len(filtered) {
+			filtered = filtered[:limit]
+		}
+	}
+
+	return filtered
+}
+
+// sortKeyRank returns the relative order of a `$sortBy` result's type, so that
+// mixed types still sort deterministically. Returns false for types which
+// cannot be used as a sort key.
+func sortKeyRank(v interface{}) (int, bool) {
+	switch v.(type) {
+	case nil:
+		return 0, true
+	case bool:
+		return 1, true
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, json.Number:
+		return 2, true
+	case string:
+		return 3, true
+	}
+	return 0, false
+}
+
+// compareSortKeys compares two `$sortBy` results and returns a negative
+// number, zero, or a positive number like `strings.Compare`.
+func compareSortKeys(a, b interface{}) int {
+	rankA, _ := sortKeyRank(a)
+	rankB, _ := sortKeyRank(b)
+	if rankA != rankB {
+		return rankA - rankB
+	}
+
+	switch at := a.(type) {
+	case bool:
+		bt := b.(bool)
+		if at == bt {
+			return 0
+		}
+		if !at {
+			return -1
+		}
+		return 1
+	case string:
+		return strings.Compare(at, b.(string))
+	case nil:
+		return 0
+	}
+
+	af, _ := toFloat(a)
+	bf, _ := toFloat(b)
+	switch {
+	case af < bf:
+		return -1
+	case af > bf:
+		return 1
+	}
+	return 0
+}
+
+// toFloat converts any Go numeric type into a float64.
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// toInt converts a numeric value into an int if it has no fractional part.
+func toInt(v interface{}) (int, bool) {
+	f, ok := toFloat(v)
+	if !ok || f != float64(int(f)) {
+		return 0, false
+	}
+	return int(f), true
 }
 
 func handleFlatten(ctx *context, v map[string]interface{}, params map[string]interface{}) interface{} {
 	result := render(ctx.WithPath("$flatten"), v["$flatten"], params)
 
 	if s, ok := result.([]interface{}); ok {
+		sources := ctx.Meta.Sources
 		tmp := make([]interface{}, 0, len(s))
-		for _, items := range s {
-			tmp = append(tmp, items.([]interface{})...)
+		var origins []*context
+		for i, items := range s {
+			inner := items.([]interface{})
+			tmp = append(tmp, inner...)
+			if sources != nil {
+				for j := range inner {
+					origins = append(origins, sources.item(inner, j, sources.item(s, i, nil)))
+				}
+			}
+		}
+		sources.setItems(tmp, origins)
+		sources.setOrigin(ctx)
+		return tmp
+	}
+
+	return ctx.AddError(ErrNotIterable.errorf("error rendering: $flatten result is not iterable"))
+}
+
+func handleMerge(ctx *context, v map[string]interface{}, params map[string]interface{}) interface{} {
+	result := render(ctx.WithPath("$merge"), v["$merge"], params)
+	if result == nil {
+		// Nothing to merge, e.g. a `$for` over a missing input.
+		return nil
+	}
+
+	if s, ok := result.([]interface{}); ok {
+		merged := map[string]interface{}{}
+		for i, item := range s {
+			obj, ok := item.(map[string]interface{})
+			if !ok {
+				return ctx.WithPath("$merge").AddError(ErrTypeMismatch.errorf("error rendering: $merge item %d is not an object: %v", i, item))
+			}
+			merged = deepMerge(ctx.Meta, merged, obj)
+		}
+		ctx.Meta.Sources.setOrigin(ctx)
+		return merged
+	}
+
+	return ctx.AddError(ErrNotIterable.errorf("error rendering: $merge result is not iterable"))
+}
+
+// deepMerge returns a new object with the properties of `b` recursively
+// merged on top of `a`. Nested objects are merged while all other values,
+// including arrays, are replaced. Neither input is modified.
+func deepMerge(meta *contextMeta, a, b map[string]interface{}) map[string]interface{} {
+	sources := meta.Sources
+	result := make(map[string]interface{}, len(a)+len(b))
+	for k, v := range a {
+		result[k] = v
+		sources.setKey(result, k, sources.key(a, k, nil))
+	}
+
+	for k, v := range b {
+		if bv, ok := v.(map[string]interface{}); ok {
+			if av, ok := result[k].(map[string]interface{}); ok {
+				result[k] = deepMerge(meta, av, bv)
+				continue
+			}
 		}
+		result[k] = v
+		sources.setKey(result, k, sources.key(b, k, nil))
+	}
+
+	if meta.Order != nil {
+		// Keep the order of `a`, followed by any new keys from `b`.
+		meta.Order.set(result, append(meta.Order.get(a), meta.Order.get(b)...))
+	}
+
+	return result
+}
+
+// handleObject renders a plain object without any special operators except
+// `$spread`, rendering each of its keys and values.
+func handleObject(ctx *context, v map[string]interface{}, params map[string]interface{}) interface{} {
+	tmp := map[string]interface{}{}
+	var spreadKeys []string
+	if v["$spread"] != nil {
+		spreadKeys = handleSpread(ctx.WithPath("$spread"), v["$spread"], params, tmp)
+	}
+
+	var keys []string
+	renderProperty := func(k string, v interface{}) {
+		var kr interface{}
+		if strings.HasPrefix(k, "$$") {
+			kr = unescapeKey(k)
+		} else {
+			kr = render(ctx.WithPath(k), k, params)
+		}
+		if krs, ok := kr.(string); ok {
+			vr := render(ctx.WithPath(k), v, params)
+			if vr != nil {
+				tmp[krs] = vr
+				keys = append(keys, krs)
+				ctx.Meta.Sources.setKey(tmp, krs, ctx.Meta.Sources.last())
+			}
+		}
+	}
+
+	if ctx.Meta.Order == nil {
+		for k, v := range v {
+			if k != "$spread" {
+				renderProperty(k, v)
+			}
+		}
+		ctx.Meta.Sources.setOrigin(ctx)
 		return tmp
 	}
 
-	return ctx.AddError(fmt.Errorf("error rendering: $flatten result is not iterable"))
+	// Render in template order, placing any spread properties where the
+	// `$spread` key is within the object.
+	for _, k := range ctx.Doc.templateKeys(ctx.Path, v) {
+		if k == "$spread" {
+			keys = append(keys, spreadKeys...)
+			continue
+		}
+		renderProperty(k, v[k])
+	}
+	ctx.Meta.Order.set(tmp, keys)
+	ctx.Meta.Sources.setOrigin(ctx)
+
+	return tmp
+}
+
+// handleSpread renders the `$spread` value of an object, which must be an
+// object or list of objects, and copies its properties into the target. If
+// order is being preserved, then the spread keys are returned in order.
+func handleSpread(ctx *context, v interface{}, params map[string]interface{}, target map[string]interface{}) []string {
+	result := render(ctx, v, params)
+
+	sources, ok := result.([]interface{})
+	if !ok {
+		sources = []interface{}{result}
+	}
+
+	var keys []string
+	for _, source := range sources {
+		switch s := source.(type) {
+		case nil:
+			// Nothing to spread, e.g. an optional input was not given.
+		case map[string]interface{}:
+			for k, v := range s {
+				target[k] = v
+				ctx.Meta.Sources.setKey(target, k, ctx.Meta.Sources.key(s, k, ctx))
+			}
+			if ctx.Meta.Order != nil {
+				keys = append(keys, ctx.Meta.Order.get(s)...)
+			}
+		default:
+			ctx.AddError(ErrTypeMismatch.errorf("error rendering: $spread must result in an object but found %v", source))
+		}
+	}
+
+	return keys
+}
+
+func handleLet(ctx *context, v map[string]interface{}, params map[string]interface{}) interface{} {
+	bindings, ok := v["$let"].(map[string]interface{})
+	if !ok {
+		return ctx.WithPath("$let").AddError(ErrInvalidOperator.errorf("error rendering: $let must be an object"))
+	}
+
+	// All bindings are evaluated using the outer scope, then made available
+	// as local variables within `$in`.
+	paramsCopy := map[string]interface{}{}
+	for k, v := range params {
+		paramsCopy[k] = v
+	}
+	for name, value := range bindings {
+		paramsCopy[name] = render(ctx.WithPath("$let").WithPath(name), value, params)
+	}
+
+	return render(ctx.WithPath("$in"), v["$in"], paramsCopy)
+}
+
+func handleRef(ctx *context, v map[string]interface{}, params map[string]interface{}) interface{} {
+	name, _ := refName(v["$ref"])
+
+	def, ok := resolveDefinition(ctx, v, name)
+	if !ok {
+		return ctx.WithPath("$ref").AddError(ErrDefinitionNotFound.errorf("error rendering: definition %s not found", name))
+	}
+
+	if len(ctx.Refs) >= maxRefDepth {
+		return ctx.WithPath("$ref").AddError(ErrMaxDepth.errorf("error rendering: definitions nested more than %d deep", maxRefDepth))
+	}
+
+	return render(ctx.WithRef(def), def.Template, params)
+}
+
+// resolveDefinition returns the definition used by a `$ref` or `$call` object,
+// resolved when compiling if available.
+func resolveDefinition(ctx *context, v map[string]interface{}, name string) (*definition, bool) {
+	if def := ctx.Program.operator(v).def; def != nil {
+		return def, true
+	}
+	return ctx.Doc.getDefinition(name)
+}
+
+func handleCall(ctx *context, v map[string]interface{}, params map[string]interface{}) interface{} {
+	name, ok := v["$call"].(string)
+	if !ok {
+		return ctx.WithPath("$call").AddError(ErrInvalidOperator.errorf("error rendering: $call must be a definition name"))
+	}
+
+	def, ok := resolveDefinition(ctx, v, name)
+	if !ok {
+		return ctx.WithPath("$call").AddError(ErrDefinitionNotFound.errorf("error rendering: definition %s not found", name))
+	}
+
+	if len(ctx.Refs) >= maxRefDepth {
+		return ctx.WithPath("$call").AddError(ErrMaxDepth.errorf("error rendering: definitions nested more than %d deep", maxRefDepth))
+	}
+
+	args := map[string]interface{}{}
+	if v["$with"] != nil {
+		result := render(ctx.WithPath("$with"), v["$with"], params)
+		if m, ok := result.(map[string]interface{}); ok {
+			// Copy since the result may be a param or constant, which are shared
+			// and must not be modified when setting defaults.
+			args = copyMap(m)
+		} else {
+			return ctx.WithPath("$with").AddError(ErrTypeMismatch.errorf("error rendering: $with must be an object but found %v", result))
+		}
+	}
+
+	if def.Schema != nil {
+		if err := def.Schema.Validate(args); err != nil {
+			return ctx.WithPath("$with").AddError(ErrInvalidArguments.errorf("error rendering: invalid arguments for %s: %w", name, err))
+		}
+		coerceNumbers(def.Schema, args)
+		setDefaults(def.Schema, args)
+	}
+
+	// Arguments are bound as local variables, shadowing any params with the
+	// same name.
+	paramsCopy := map[string]interface{}{}
+	for k, v := range params {
+		paramsCopy[k] = v
+	}
+	for k, v := range args {
+		paramsCopy[k] = v
+	}
+
+	return render(ctx.WithRef(def), def.Template, paramsCopy)
+}
+
+func handleInclude(ctx *context, v map[string]interface{}, params map[string]interface{}) interface{} {
+	filename, ok := v["$include"].(string)
+	if !ok {
+		return ctx.WithPath("$include").AddError(ErrInvalidOperator.errorf("error rendering: $include must be a filename"))
+	}
+
+	included := ctx.Program.operator(v).included
+	var err error
+	if included == nil {
+		included, err = ctx.Doc.loadInclude(filename)
+	}
+	if err != nil {
+		return ctx.WithPath("$include").AddError(ErrInclude.errorf("error rendering: unable to include %s: %w", filename, err))
+	}
+
+	if cycle := ctx.IncludeCycle(included); cycle != nil {
+		return ctx.WithPath("$include").AddError(ErrIncludeCycle.errorf("error rendering: include cycle detected: %s", strings.Join(cycle, " -> ")))
+	}
+
+	return render(ctx.WithInclude(included), included.Template, params)
 }
 
 func handleInterpolation(ctx *context, v string, params map[string]interface{}) interface{} {
+	var matches [][]int
+	var asts []*mexpr.Node
+	if compiled := ctx.Program.lookup(v); compiled != nil {
+		matches, asts = compiled.matches, compiled.asts
+	} else {
+		var scanErr *scanError
+		matches, scanErr = findInterpolations(v)
+		if scanErr != nil {
+			return ctx.AddErrorOffset(ErrExprCompile.errorf("error rendering: %w", scanErr), scanErr.Offset(), scanErr.Length())
+		}
+	}
+
+	eval := func(i int, expr string) (interface{}, *mexpr.Node, mexpr.Error) {
+		var ast *mexpr.Node
+		if asts != nil {
+			ast = asts[i]
+		}
+		if ast == nil {
+			var err mexpr.Error
+			if ast, err = mexpr.Parse(expr, nil); err != nil {
+				return nil, nil, err
+			}
+		}
+		ast, err := exprNumbers(ast, params)
+		if err != nil {
+			return nil, nil, err
+		}
+		result, err := mexpr.Run(ast, params)
+		return result, ast, err
+	}
+
 	// Special case: full replacement; Could by any type, not just str so we
 	// can't replace by strings and instead just return the one value from the
 	// expression given the current context.
-	matches := interpolationRe.FindAllString(v, -1)
-	if len(matches) == 1 && len(matches[0]) == len(v) {
-		result, err := mexpr.Eval(v[2:len(v)-1], params)
+	if isFullInterpolation(v, matches) {
+		result, ast, err := eval(0, v[2:len(v)-1])
 		if err != nil {
-			return ctx.AddError(fmt.Errorf("error rendering: %s", err.Pretty(v[2:len(v)-1])))
+			return ctx.AddError(ErrExprEval.errorf("error rendering: %s", err.Pretty(v[2:len(v)-1])))
+		}
+		result = arithmeticResult(ast, result)
+		if s, ok := result.(string); ok && !ctx.Meta.Limits.checkString(ctx, len(s)) {
+			return nil
 		}
 		return result
 	}
 
+	if len(matches) == 0 {
+		return unescape(v, false)
+	}
+
 	// Everything else generates a string as output.
-	interpolated := interpolationRe.ReplaceAllStringFunc(v, func(v string) string {
-		result, err := mexpr.Eval(v[2:len(v)-1], params)
+	var sb strings.Builder
+	last := 0
+	for i, match := range matches {
+		sb.WriteString(unescape(v[last:match[0]], true))
+		last = match[1]
+
+		expr := v[match[0]+2 : match[1]-1]
+		result, _, err := eval(i, expr)
 		if err != nil {
-			ctx.AddError(fmt.Errorf("error rendering: %s", err.Pretty(v[2:len(v)-1])))
-			return ""
+			ctx.AddError(ErrExprEval.errorf("error rendering: %s", err.Pretty(expr)))
+			continue
 		}
 		if result != nil {
-			return fmt.Sprintf("%v", result)
+			sb.WriteString(formatInterpolated(result))
+		}
+		if !ctx.Meta.Limits.checkString(ctx, sb.Len()) {
+			return nil
+		}
+	}
+	sb.WriteString(unescape(v[last:], false))
+
+	return sb.String()
+}
+
+// arithmeticResult converts the result of an arithmetic expression back into
+// an int64 if it has no fractional part, since expressions always compute
+// numbers as floats. Results beyond 2^53 are left as-is since they may have
+// already lost precision.
+func arithmeticResult(ast *mexpr.Node, result interface{}) interface{} {
+	switch ast.Type {
+	case mexpr.NodeAdd, mexpr.NodeSubtract, mexpr.NodeMultiply, mexpr.NodeDivide, mexpr.NodeModulus, mexpr.NodePower, mexpr.NodeSign:
+		if f, ok := result.(float64); ok && math.Abs(f) <= 1<<53 {
+			if i, ok := floatToInt64(f); ok {
+				return i
+			}
+		}
+	}
+	return result
+}
+
+// maxExactInt is the largest magnitude below which every integer can be
+// represented exactly by a float64, which expressions use for all numbers.
+const maxExactInt = 1 << 53
+
+// exprNumbers returns an expression's AST prepared for numbers which the
+// interpreter can't use directly. An expression which is just a path like
+// `${price}` passes values through as-is so no precision is lost. Otherwise,
+// `json.Number` values are replaced by floats and integers too large to be
+// represented exactly as a float are an error, rather than silently rounding
+// them. The original AST is not modified as it may be shared between renders.
+func exprNumbers(ast *mexpr.Node, params map[string]interface{}) (*mexpr.Node, mexpr.Error) {
+	if isPathNode(ast) {
+		return replaceIndexNumbers(ast, params)
+	}
+	return replaceNumbers(ast, params)
+}
+
+func replaceNumbers(n *mexpr.Node, params map[string]interface{}) (*mexpr.Node, mexpr.Error) {
+	if n == nil {
+		return nil, nil
+	}
+
+	if isPathNode(n) {
+		n, err := replaceIndexNumbers(n, params)
+		if err != nil {
+			return nil, err
+		}
+		v, ok := pathValue(n, params)
+		if !ok {
+			// Leave it to the interpreter to report the error.
+			return n, nil
+		}
+		offset, length := pathSpan(n)
+		switch t := v.(type) {
+		case int:
+			if int64(t) > maxExactInt || int64(t) < -maxExactInt {
+				return nil, mexpr.NewError(offset, length, "integer %d is too large to use in an expression without losing precision", t)
+			}
+		case int64:
+			if t > maxExactInt || t < -maxExactInt {
+				return nil, mexpr.NewError(offset, length, "integer %d is too large to use in an expression without losing precision", t)
+			}
+		case json.Number:
+			f, ferr := t.Float64()
+			if ferr != nil || !strings.ContainsAny(t.String(), ".eE") {
+				return nil, mexpr.NewError(offset, length, "number %s is too large to use in an expression without losing precision", t)
+			}
+			return &mexpr.Node{Type: mexpr.NodeLiteral, Value: f, Offset: n.Offset, Length: n.Length}, nil
+		}
+		return n, nil
+	}
+
+	left, err := replaceNumbers(n.Left, params)
+	if err != nil {
+		return nil, err
+	}
+	right, err := replaceNumbers(n.Right, params)
+	if err != nil {
+		return nil, err
+	}
+	return withChildren(n, left, right), nil
+}
+
+// replaceIndexNumbers prepares the computed indexes within a path expression
+// node like `items[i + 1]`, leaving the path itself as-is.
+func replaceIndexNumbers(n *mexpr.Node, scope interface{}) (*mexpr.Node, mexpr.Error) {
+	if !hasComputedIndex(n) {
+		return n, nil
+	}
+
+	left, err := replaceIndexNumbers(n.Left, scope)
+	if err != nil {
+		return nil, err
+	}
+	right := n.Right
+	switch n.Type {
+	case mexpr.NodeFieldSelect:
+		selected, _ := pathValue(left, scope)
+		right, err = replaceIndexNumbers(n.Right, selected)
+	case mexpr.NodeArrayIndex:
+		params, _ := scope.(map[string]interface{})
+		right, err = replaceNumbers(n.Right, params)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return withChildren(n, left, right), nil
+}
+
+// withChildren returns the node with the given children, copying it only if
+// they have changed.
+func withChildren(n, left, right *mexpr.Node) *mexpr.Node {
+	if left == n.Left && right == n.Right {
+		return n
+	}
+	tmp := *n
+	tmp.Left = left
+	tmp.Right = right
+	return &tmp
+}
+
+// isPathNode returns whether an expression node just selects a value from the
+// params, like `items[0].price`. Note that the interpreter evaluates the right
+// side of a field select, including any index within it, against the object
+// selected by the left side.
+func isPathNode(n *mexpr.Node) bool {
+	switch n.Type {
+	case mexpr.NodeIdentifier:
+		return true
+	case mexpr.NodeFieldSelect:
+		return isPathNode(n.Left) && n.Right != nil && isPathNode(n.Right)
+	case mexpr.NodeArrayIndex:
+		return isPathNode(n.Left) && n.Right != nil && n.Right.Type != mexpr.NodeSlice
+	}
+	return false
+}
+
+// hasComputedIndex returns whether a path expression node indexes an array
+// with anything other than a literal, like `items[i]`.
+func hasComputedIndex(n *mexpr.Node) bool {
+	switch n.Type {
+	case mexpr.NodeFieldSelect:
+		return hasComputedIndex(n.Left) || hasComputedIndex(n.Right)
+	case mexpr.NodeArrayIndex:
+		return n.Right.Type != mexpr.NodeLiteral || hasComputedIndex(n.Left)
+	}
+	return false
+}
+
+// pathValue returns the value selected by a path expression node from the
+// given scope. Simple paths are looked up directly as this runs for every
+// render, only falling back to the interpreter for everything else, e.g.
+// computed indexes like `items[i + 1]`.
+func pathValue(n *mexpr.Node, scope interface{}) (interface{}, bool) {
+	switch n.Type {
+	case mexpr.NodeIdentifier:
+		if m, ok := scope.(map[string]interface{}); ok {
+			name, _ := n.Value.(string)
+			if v, ok := m[name]; ok {
+				return v, true
+			}
+		}
+	case mexpr.NodeFieldSelect:
+		selected, ok := pathValue(n.Left, scope)
+		if !ok {
+			return nil, false
+		}
+		return pathValue(n.Right, selected)
+	case mexpr.NodeArrayIndex:
+		index, ok := n.Right.Value.(float64)
+		if n.Right.Type != mexpr.NodeLiteral || !ok || index != math.Trunc(index) {
+			break
+		}
+		parent, ok := pathValue(n.Left, scope)
+		if !ok {
+			return nil, false
+		}
+		items, ok := parent.([]interface{})
+		if !ok {
+			break
+		}
+		i := int(index)
+		if i < 0 {
+			i += len(items)
+		}
+		if i < 0 || i >= len(items) {
+			return nil, false
+		}
+		return items[i], true
+	}
+
+	v, err := mexpr.NewInterpreter(n).Run(scope)
+	return v, err == nil
+}
+
+// pathSpan returns the offset and length of the source of a path expression
+// node like `items[0].price`.
+func pathSpan(n *mexpr.Node) (uint16, uint8) {
+	start, end := n.Offset, n.Offset+uint16(n.Length)
+	switch n.Type {
+	case mexpr.NodeFieldSelect, mexpr.NodeArrayIndex:
+		start, _ = pathSpan(n.Left)
+		rightStart, rightLength := pathSpan(n.Right)
+		end = rightStart + uint16(rightLength)
+		if n.Type == mexpr.NodeArrayIndex {
+			// Include the closing bracket.
+			end++
 		}
-		return ""
-	})
+	}
+	if end-start > math.MaxUint8 {
+		end = start + math.MaxUint8
+	}
+	return start, uint8(end - start)
+}
 
-	return interpolated
+// formatInterpolated formats an expression result for use within a larger
+// string. Floats are written without exponents where possible, so that e.g.
+// 1000000 is not written as 1e+06.
+func formatInterpolated(v interface{}) string {
+	switch n := v.(type) {
+	case float64:
+		if math.Abs(n) < 1e21 {
+			return strconv.FormatFloat(n, 'f', -1, 64)
+		}
+	case float32:
+		if math.Abs(float64(n)) < 1e21 {
+			return strconv.FormatFloat(float64(n), 'f', -1, 32)
+		}
+	}
+	return fmt.Sprintf("%v", v)
 }
 
 func render(ctx *context, template interface{}, params map[string]interface{}) interface{} {
+	if limits := ctx.Meta.Limits; limits != nil {
+		if !limits.enter(ctx) {
+			return nil
+		}
+		defer limits.exit()
+	}
+
 	switch v := template.(type) {
 	case map[string]interface{}:
 		// This is an object in the template. First, handle special syntax for
 		// branching/looping/etc, then if none of those are present, fall back
 		// to normal key/value recursive processing.
-		if v["$if"] != nil {
+		switch ctx.Program.operator(v).name {
+		case "$literal":
+			literal := v["$literal"]
+			ctx.Meta.Order.setTemplate(ctx.Doc, ctx.WithPath("$literal").Path, literal)
+			ctx.Meta.Sources.setOrigin(ctx.WithPath("$literal"))
+			return literal
+		case "$if":
 			return handleBranch(ctx, v, params)
-		}
-		if v["$for"] != nil {
+		case "$switch":
+			return handleSwitch(ctx, v, params)
+		case "$for":
 			return handleLoop(ctx, v, params)
-		}
-		if v["$flatten"] != nil {
+		case "$flatten":
 			return handleFlatten(ctx, v, params)
+		case "$merge":
+			return handleMerge(ctx, v, params)
+		case "$let":
+			return handleLet(ctx, v, params)
+		case "$ref":
+			return handleRef(ctx, v, params)
+		case "$call":
+			return handleCall(ctx, v, params)
+		case "$include":
+			return handleInclude(ctx, v, params)
 		}
 
-		tmp := map[string]interface{}{}
-		for k, v := range v {
-			kr := render(ctx.WithPath(k), k, params)
-			if krs, ok := kr.(string); ok {
-				vr := render(ctx.WithPath(k), v, params)
-				if vr != nil {
-					tmp[krs] = vr
-				}
-			}
-		}
-		return tmp
+		return handleObject(ctx, v, params)
 	case []interface{}:
 		tmp := []interface{}{}
+		var origins []*context
 
 		for i, item := range v {
 			result := render(ctx.WithPath(i), item, params)
 			if result != nil {
 				tmp = append(tmp, result)
+				if ctx.Meta.Sources != nil {
+					origins = append(origins, ctx.Meta.Sources.last())
+				}
 			}
 		}
 
+		ctx.Meta.Sources.setItems(tmp, origins)
+		ctx.Meta.Sources.setOrigin(ctx)
 		return tmp
 	case string:
-		return handleInterpolation(ctx, v, params)
+		result := handleInterpolation(ctx, v, params)
+		ctx.Meta.Sources.setOrigin(ctx)
+		return result
 	}
 
+	ctx.Meta.Sources.setOrigin(ctx)
 	return template
 }
@@ -0,0 +1,246 @@
+package sdt
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// SourceMap maps paths within rendered output back to the template locations
+// which produced them, accounting for loops, branches, and other operators.
+// Pass one via `RenderOptions.SourceMap` to have it filled in while rendering.
+type SourceMap struct {
+	paths map[string]*context
+}
+
+// Lookup returns the template location, e.g. `doc.yaml#/template/items/$each`,
+// which produced the value at the given JSON Pointer path in the output. If
+// the value itself has no known location, e.g. because it came directly from
+// the input params, then the location of the closest parent is returned.
+func (m *SourceMap) Lookup(path string) (string, bool) {
+	if ctx := m.context(path); ctx != nil {
+		return ctx.FullPath(), true
+	}
+	return "", false
+}
+
+// context returns the template context which produced the value at the given
+// output path or its closest parent.
+func (m *SourceMap) context(path string) *context {
+	if m == nil || m.paths == nil {
+		return nil
+	}
+	path = strings.TrimSuffix(path, "/")
+	for {
+		if ctx, ok := m.paths[path]; ok {
+			return ctx
+		}
+		if path == "" {
+			return nil
+		}
+		if i := strings.LastIndex(path, "/"); i >= 0 {
+			path = path[:i]
+		} else {
+			path = ""
+		}
+	}
+}
+
+// build fills in the source map by walking the rendered output using the
+// template locations recorded while rendering.
+func (m *SourceMap) build(r *sourceRecorder, out interface{}, root *context) {
+	m.paths = map[string]*context{}
+	var walk func(path string, v interface{}, ctx *context)
+	walk = func(path string, v interface{}, ctx *context) {
+		m.paths[path] = ctx
+		switch t := v.(type) {
+		case map[string]interface{}:
+			for k, v := range t {
+				walk(path+"/"+escapePointer(k), v, r.key(t, k, ctx))
+			}
+		case []interface{}:
+			for i, item := range t {
+				walk(fmt.Sprintf("%s/%d", path, i), item, r.item(t, i, ctx))
+			}
+		}
+	}
+	walk("", out, root)
+}
+
+// escapePointer escapes a key for use within a JSON Pointer.
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// sourceRecorder records the template locations of values created while
+// rendering, so that a source map can be built from the output.
+type sourceRecorder struct {
+	// origin is the location of the most recently rendered value. Operators
+	// which return the result of rendering another part of the template leave
+	// it as-is, so it points at the innermost template value.
+	origin *context
+
+	keys  map[uintptr]map[string]*context
+	items map[uintptr][]*context
+
+	// objects keeps each recorded object alive until the render is complete
+	// so that its address is not reused by another object.
+	objects []interface{}
+}
+
+func newSourceRecorder() *sourceRecorder {
+	return &sourceRecorder{
+		keys:  map[uintptr]map[string]*context{},
+		items: map[uintptr][]*context{},
+	}
+}
+
+// setOrigin sets the location of the value which was just rendered. Safe to
+// call on nil, which does nothing.
+func (r *sourceRecorder) setOrigin(ctx *context) {
+	if r == nil {
+		return
+	}
+	r.origin = ctx
+}
+
+// last returns the location of the most recently rendered value. Safe to call
+// on nil, which returns nil.
+func (r *sourceRecorder) last() *context {
+	if r == nil {
+		return nil
+	}
+	return r.origin
+}
+
+// setKey records the location of an object's property. Safe to call on nil.
+func (r *sourceRecorder) setKey(m map[string]interface{}, k string, ctx *context) {
+	if r == nil || ctx == nil {
+		return
+	}
+	ptr := reflect.ValueOf(m).Pointer()
+	if r.keys[ptr] == nil {
+		r.keys[ptr] = map[string]*context{}
+		r.objects = append(r.objects, m)
+	}
+	r.keys[ptr][k] = ctx
+}
+
+// key returns the location of an object's property, or the fallback if it
+// was not recorded.
+func (r *sourceRecorder) key(m map[string]interface{}, k string, fallback *context) *context {
+	if r != nil {
+		if ctx := r.keys[reflect.ValueOf(m).Pointer()][k]; ctx != nil {
+			return ctx
+		}
+	}
+	return fallback
+}
+
+// setItems records the location of each item in an array. Safe to call on
+// nil.
+func (r *sourceRecorder) setItems(s []interface{}, ctxs []*context) {
+	if r == nil || len(s) == 0 {
+		return
+	}
+	r.items[reflect.ValueOf(s).Pointer()] = ctxs
+	r.objects = append(r.objects, s)
+}
+
+// item returns the location of an array item, or the fallback if it was not
+// recorded.
+func (r *sourceRecorder) item(s []interface{}, i int, fallback *context) *context {
+	if r != nil && len(s) > 0 {
+		if ctxs := r.items[reflect.ValueOf(s).Pointer()]; i < len(ctxs) && ctxs[i] != nil {
+			return ctxs[i]
+		}
+	}
+	return fallback
+}
+
+// ValidateOutputSources validates the rendered output against the output
+// schema. Unlike `ValidateOutput`, an error is returned for each invalid
+// value, positioned at the template location which produced it using the
+// source map recorded while rendering.
+func (doc *Document) ValidateOutputSources(output interface{}, sources *SourceMap) []ContextError {
+	if doc.Schemas == nil || doc.Schemas.Output == nil {
+		return nil
+	}
+
+	if err := doc.LoadSchemas(); err != nil {
+		ctx := newContext(doc, "schemas", "output")
+		ctx.AddError(err)
+		return ctx.Meta.Errors
+	}
+	if doc.outputSchema == nil {
+		ctx := newContext(doc, "schemas", "output")
+		ctx.AddError(ErrInvalidSchema.errorf("output schema could not be loaded"))
+		return ctx.Meta.Errors
+	}
+
+	plain := plainValue(output)
+	err := doc.outputSchema.Validate(plain)
+	if err == nil {
+		return nil
+	}
+
+	meta := &contextMeta{}
+	root := newContext(doc, "template")
+	root.Meta = meta
+
+	problems, ok := schemaProblems(err, doc.outputSchema, plain)
+	if !ok {
+		root.AddError(ErrInvalidOutput.errorf("error validating output against schema: %w", err))
+		return meta.Errors
+	}
+
+	for _, p := range problems {
+		path := p.location
+		if p.property != "" {
+			path += "/" + escapePointer(p.property)
+		}
+		ctx := sources.context(path)
+		if ctx == nil {
+			ctx = root
+		}
+		errCtx := *ctx
+		errCtx.Meta = meta
+
+		location := p.location
+		if location == "" {
+			location = "/"
+		}
+
+		if p.property != "" {
+			errCtx.AddError(ErrUnknownProperty.errorf("error validating output at %s: property %s is not allowed", location, p.property))
+			continue
+		}
+
+		errCtx.AddError(ErrInvalidOutput.errorf("error validating output at %s: %s, rendered value: %s", location, p.message, formatDiffValue(valueAt(plain, p.location))))
+	}
+
+	return meta.Errors
+}
+
+// valueAt returns the value at the JSON Pointer path within a value.
+func valueAt(v interface{}, path string) interface{} {
+	if path == "" || path == "/" {
+		return v
+	}
+	for _, part := range strings.Split(strings.TrimPrefix(path, "/"), "/") {
+		part = strings.NewReplacer("~1", "/", "~0", "~").Replace(part)
+		switch t := v.(type) {
+		case map[string]interface{}:
+			v = t[part]
+		case []interface{}:
+			var i int
+			if _, err := fmt.Sscanf(part, "%d", &i); err != nil || i < 0 || i >= len(t) {
+				return nil
+			}
+			v = t[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
@@ -0,0 +1,140 @@
+package sdt
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/danielgtaylor/mexpr"
+)
+
+// operatorNames are the special `$` keys which may be used in templates.
+var operatorNames = func() []string {
+	names := []string{"$spread"}
+	for _, op := range operatorClauses {
+		names = append(names, op.name)
+		names = append(names, op.clauses...)
+	}
+	return names
+}()
+
+// editDistance returns the number of single character insertions, deletions,
+// substitutions, or swaps of adjacent characters needed to turn one string
+// into the other. Swaps are included since they are a common typo.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	d := make([][]int, len(ra)+1)
+	for i := range d {
+		d[i] = make([]int, len(rb)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d[i][j] = minInt(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				d[i][j] = minInt(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(ra)][len(rb)]
+}
+
+func minInt(first int, rest ...int) int {
+	for _, v := range rest {
+		if v < first {
+			first = v
+		}
+	}
+	return first
+}
+
+// closest returns the option which is most similar to the name, or an empty
+// string if none are close enough to likely be what was meant. Ties go to the
+// option which sorts first so results are stable.
+func closest(name string, options []string) string {
+	sorted := append([]string{}, options...)
+	sort.Strings(sorted)
+
+	// Allow roughly one typo per three characters, so short names don't match
+	// everything.
+	maxDistance := len([]rune(name)) / 3
+	if maxDistance < 1 {
+		maxDistance = 1
+	}
+
+	best := ""
+	bestDistance := maxDistance + 1
+	for _, option := range sorted {
+		if option == name {
+			continue
+		}
+		d := editDistance(strings.ToLower(name), strings.ToLower(option))
+		if d < bestDistance {
+			best = option
+			bestDistance = d
+		}
+	}
+	return best
+}
+
+// didYouMean returns a suggestion like `, did you mean 'name'?` to append to
+// an error message, or an empty string if no option is similar to the name.
+func didYouMean(name string, options []string) string {
+	if match := closest(name, options); match != "" {
+		return fmt.Sprintf(", did you mean '%s'?", match)
+	}
+	return ""
+}
+
+// identifierSuggestion returns a suggestion for an unknown identifier which
+// caused an expression to fail to compile, based on the names available at
+// that point in the expression, e.g. the keys of the selected object.
+func identifierSuggestion(expr string, err mexpr.Error, params map[string]interface{}) string {
+	if !strings.HasPrefix(err.Error(), "no property ") {
+		return ""
+	}
+
+	ast, perr := mexpr.Parse(expr, nil)
+	if perr != nil || ast == nil {
+		return ""
+	}
+
+	// Find the unknown identifier and the object it is selected from.
+	var name string
+	var scope interface{}
+	var find func(n, parent *mexpr.Node) bool
+	find = func(n, parent *mexpr.Node) bool {
+		if n == nil {
+			return false
+		}
+		if n.Type == mexpr.NodeIdentifier && n.Offset == err.Offset() {
+			name, _ = n.Value.(string)
+			scope = params
+			if parent != nil && parent.Type == mexpr.NodeFieldSelect && parent.Right == n {
+				scope, _ = mexpr.Run(parent.Left, params)
+			}
+			return true
+		}
+		return find(n.Left, n) || find(n.Right, n)
+	}
+	if !find(ast, nil) {
+		return ""
+	}
+
+	m, ok := scope.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return didYouMean(name, keys)
+}
@@ -0,0 +1,319 @@
+package sdt
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Test is a single test case for a document. It renders the document's
+// template with the given input and compares the result to the expected
+// output. If errors are expected, then each expected string must be found in
+// at least one of the returned errors. Likewise for warnings from validating
+// the template, though other warnings do not fail the test.
+type Test struct {
+	Name     string                 `json:"name,omitempty" yaml:"name,omitempty"`
+	Input    map[string]interface{} `json:"input" yaml:"input"`
+	Errors   []string               `json:"errors,omitempty" yaml:"errors,omitempty"`
+	Warnings []string               `json:"warnings,omitempty" yaml:"warnings,omitempty"`
+	Expected interface{}            `json:"expected" yaml:"expected"`
+}
+
+// TestResult describes the outcome of running a single test case.
+type TestResult struct {
+	// Name of the test that was run.
+	Name string
+
+	// Output is the rendered output, if rendering was successful.
+	Output interface{}
+
+	// Failures lists reasons why the test failed. It is empty on success.
+	Failures []string
+
+	// Diff lists the differences between the expected and actual output.
+	Diff []string
+}
+
+// Passed returns whether the test case was successful.
+func (r *TestResult) Passed() bool {
+	return len(r.Failures) == 0 && len(r.Diff) == 0
+}
+
+// testFilename returns the sidecar test filename for a document, e.g.
+// `foo.sdt.yaml` becomes `foo.sdt.test.yaml`.
+func testFilename(filename string) string {
+	filename = stripFragment(filename)
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + ".test" + ext
+}
+
+// LoadTests loads test cases from the sidecar `*.test.yaml` file next to the
+// document, if one exists, and appends them to the document's tests.
+func (doc *Document) LoadTests() error {
+	if doc.Filename == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(testFilename(doc.Filename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var sidecar struct {
+		Tests []Test `json:"tests" yaml:"tests"`
+	}
+	if err := yaml.Unmarshal(b, &sidecar); err != nil {
+		return fmt.Errorf("error loading tests: %w", err)
+	}
+
+	doc.Tests = append(doc.Tests, sidecar.Tests...)
+	return nil
+}
+
+// matchErrors checks that each expected error is present in the list of
+// actual error messages and returns a list of failures.
+func (test *Test) matchErrors(stage string, actual []string) []string {
+	if len(test.Errors) == 0 {
+		return []string{fmt.Sprintf("unexpected error while %s: %s", stage, strings.Join(actual, "\n"))}
+	}
+
+	failures := []string{}
+outer:
+	for _, expected := range test.Errors {
+		for _, msg := range actual {
+			if strings.Contains(msg, expected) {
+				continue outer
+			}
+		}
+		failures = append(failures, fmt.Sprintf("expected error '%s' but found %v", expected, actual))
+	}
+	return failures
+}
+
+// matchWarnings checks that each expected warning is present in the list of
+// actual warning messages and returns a list of failures.
+func (test *Test) matchWarnings(actual []string) []string {
+	failures := []string{}
+outer:
+	for _, expected := range test.Warnings {
+		for _, msg := range actual {
+			if strings.Contains(msg, expected) {
+				continue outer
+			}
+		}
+		failures = append(failures, fmt.Sprintf("expected warning '%s' but found %v", expected, actual))
+	}
+	return failures
+}
+
+func contextErrorStrings(errs []ContextError) []string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return msgs
+}
+
+// RunTest runs a single test case against the document. The template is
+// validated, then the input is validated, the template is rendered, and
+// finally the output is validated and compared to the expected value.
+func (doc *Document) RunTest(test *Test) *TestResult {
+	result := &TestResult{Name: test.Name}
+
+	input := test.Input
+	if input == nil {
+		input = map[string]interface{}{}
+	}
+
+	warnings, errs := doc.ValidateTemplate()
+	if len(errs) > 0 {
+		result.Failures = test.matchErrors("validating template", contextErrorStrings(errs))
+		return result
+	}
+
+	if failures := test.matchWarnings(contextErrorStrings(warnings)); len(failures) > 0 {
+		result.Failures = failures
+		return result
+	}
+
+	if err := doc.ValidateInput(input); err != nil {
+		result.Failures = test.matchErrors("validating input", []string{err.Error()})
+		return result
+	}
+
+	sources := &SourceMap{}
+	out, errs := doc.RenderContext(gocontext.Background(), input, &RenderOptions{SourceMap: sources})
+	if len(errs) > 0 {
+		result.Failures = test.matchErrors("rendering", contextErrorStrings(errs))
+		return result
+	}
+	result.Output = out
+
+	if errs := doc.ValidateOutputSources(out, sources); len(errs) > 0 {
+		result.Failures = test.matchErrors("validating output", contextErrorStrings(errs))
+		return result
+	}
+
+	if len(test.Errors) > 0 {
+		result.Failures = []string{fmt.Sprintf("expected errors %v but found none", test.Errors)}
+		return result
+	}
+
+	// Round trip to normalize all numbers in the output to make writing
+	// test expectations easier in YAML.
+	tmp, _ := yaml.Marshal(out)
+	var normalized interface{}
+	yaml.Unmarshal(tmp, &normalized)
+
+	result.Diff = diff("", test.Expected, normalized)
+
+	return result
+}
+
+// RunTests runs all of the document's test cases in order.
+func (doc *Document) RunTests() []*TestResult {
+	results := make([]*TestResult, 0, len(doc.Tests))
+	for i := range doc.Tests {
+		results = append(results, doc.RunTest(&doc.Tests[i]))
+	}
+	return results
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// diff returns a human-readable list of the differences between two values,
+// each prefixed with the JSON Pointer path to the difference.
+func diff(path string, expected, actual interface{}) []string {
+	switch e := expected.(type) {
+	case map[string]interface{}:
+		if a, ok := actual.(map[string]interface{}); ok {
+			diffs := []string{}
+			for _, k := range sortedKeys(e) {
+				if _, ok := a[k]; !ok {
+					diffs = append(diffs, fmt.Sprintf("%s/%s: missing, expected %s", path, k, formatDiffValue(e[k])))
+					continue
+				}
+				diffs = append(diffs, diff(path+"/"+k, e[k], a[k])...)
+			}
+			for _, k := range sortedKeys(a) {
+				if _, ok := e[k]; !ok {
+					diffs = append(diffs, fmt.Sprintf("%s/%s: unexpected %s", path, k, formatDiffValue(a[k])))
+				}
+			}
+			return diffs
+		}
+	case []interface{}:
+		if a, ok := actual.([]interface{}); ok {
+			diffs := []string{}
+			for i := 0; i < len(e) || i < len(a); i++ {
+				switch {
+				case i >= len(a):
+					diffs = append(diffs, fmt.Sprintf("%s/%d: missing, expected %s", path, i, formatDiffValue(e[i])))
+				case i >= len(e):
+					diffs = append(diffs, fmt.Sprintf("%s/%d: unexpected %s", path, i, formatDiffValue(a[i])))
+				default:
+					diffs = append(diffs, diff(fmt.Sprintf("%s/%d", path, i), e[i], a[i])...)
+				}
+			}
+			return diffs
+		}
+	}
+
+	if expected == nil && isZero(actual) {
+		// An empty expectation matches empty output, e.g. `expected: {}` vs.
+		// no expectation at all.
+		return nil
+	}
+
+	if e, ok := toRat(expected); ok {
+		if a, ok := toRat(actual); ok && e.Cmp(a) == 0 {
+			// Numbers are equal regardless of their Go type, e.g. a YAML `int`
+			// vs. an `int64` from the input or a `float64` from an expression.
+			return nil
+		}
+	}
+
+	if !reflect.DeepEqual(expected, actual) {
+		p := path
+		if p == "" {
+			p = "/"
+		}
+		return []string{fmt.Sprintf("%s: expected %s but found %s", p, formatDiffValue(expected), formatDiffValue(actual))}
+	}
+
+	return nil
+}
+
+// toRat converts any Go numeric type or `json.Number` into an exact rational
+// number for comparison.
+func toRat(v interface{}) (*big.Rat, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		return new(big.Rat).SetString(n.String())
+	case float32, float64:
+		f := reflect.ValueOf(n).Float()
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, false
+		}
+		return new(big.Rat).SetFloat64(f), true
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return new(big.Rat).SetInt64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return new(big.Rat).SetUint64(rv.Uint()), true
+	}
+	return nil, false
+}
+
+// formatDiffValue returns a compact single-line representation of a value.
+func formatDiffValue(v interface{}) string {
+	if v == nil {
+		return "null"
+	}
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	s := strings.TrimSpace(string(b))
+	if strings.Contains(s, "\n") {
+		// Use flow style for complex values to keep it on one line.
+		var node yaml.Node
+		if err := node.Encode(v); err == nil {
+			setFlowStyle(&node)
+			if b, err := yaml.Marshal(&node); err == nil {
+				s = strings.TrimSpace(string(b))
+			}
+		}
+	}
+	return s
+}
+
+func setFlowStyle(node *yaml.Node) {
+	node.Style |= yaml.FlowStyle
+	for _, child := range node.Content {
+		setFlowStyle(child)
+	}
+}
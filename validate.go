@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/danielgtaylor/mexpr"
@@ -30,6 +32,12 @@ func hasType(s *jsonschema.Schema, typ string) bool {
 	return false
 }
 
+// allowsAny returns true if the schema places no restrictions on the type of
+// the value, e.g. an empty schema `{}`.
+func allowsAny(s *jsonschema.Schema) bool {
+	return len(s.Types) == 0 && len(s.Enum) == 0
+}
+
 func getKeys(m map[string]*jsonschema.Schema) []string {
 	props := []string{}
 	for k := range m {
@@ -55,6 +63,24 @@ func getItems(s *jsonschema.Schema) *jsonschema.Schema {
 	return &jsonschema.Schema{}
 }
 
+// getPropertySchema returns the schema for an object's property, falling back
+// to pattern and additional properties. If the property is not described,
+// then an empty schema is returned.
+func getPropertySchema(s *jsonschema.Schema, name string) *jsonschema.Schema {
+	if prop := s.Properties[name]; prop != nil {
+		return prop
+	}
+	for re, prop := range s.PatternProperties {
+		if re.MatchString(name) {
+			return prop
+		}
+	}
+	if addl, ok := s.AdditionalProperties.(*jsonschema.Schema); ok {
+		return addl
+	}
+	return &jsonschema.Schema{}
+}
+
 // Copied and modified from:
 // https://github.com/santhosh-tekuri/jsonschema/blob/master/draft.go
 func findDraft(url string) *jsonschema.Draft {
@@ -102,6 +128,10 @@ func compileSchema(filename string, dialect string, input interface{}) (*jsonsch
 }
 
 func getJSONType(value interface{}) string {
+	if _, ok := value.(json.Number); ok {
+		// Kept as a string to preserve precision, but still a number.
+		return "number"
+	}
 	return map[reflect.Kind]string{
 		reflect.Bool:    "boolean",
 		reflect.Int:     "number",
@@ -129,11 +159,15 @@ func wrongTypeError(ctx *context, found string, expected *jsonschema.Schema) {
 		}
 	}
 
-	ctx.AddError(fmt.Errorf("error validating template: type %s not allowed, expecting %s%s", found, strings.Join(expected.Types, " or "), extra))
+	ctx.AddError(ErrTypeMismatch.errorf("error validating template: type %s not allowed, expecting %s%s", found, strings.Join(expected.Types, " or "), extra))
 }
 
 func validateString(ctx *context, s *jsonschema.Schema, template interface{}, paramsExample map[string]interface{}) {
-	matches := interpolationRe.FindAllStringIndex(template.(string), -1)
+	matches, scanErr := findInterpolations(template.(string))
+	if scanErr != nil {
+		ctx.AddErrorOffset(ErrExprCompile.errorf("error validating template: %w", scanErr), scanErr.Offset(), scanErr.Length())
+		return
+	}
 
 	if len(matches) > 0 {
 		for _, match := range matches {
@@ -141,20 +175,23 @@ func validateString(ctx *context, s *jsonschema.Schema, template interface{}, pa
 			ctx.Meta.TemplateComplexity++
 			_, err := mexpr.Parse(expr, paramsExample)
 			if err != nil {
-				ctx.AddErrorOffset(fmt.Errorf("error validating template: unable to compile expression '%s': %v", expr, err), uint16(match[0])+err.Offset()+2, err.Length())
-				if len(matches) == 1 && match[0] == 0 && match[1] == len(template.(string)) {
+				ctx.AddErrorOffset(ErrExprCompile.errorf("error validating template: unable to compile expression '%s': %v%s", expr, err, identifierSuggestion(expr, err, paramsExample)), uint16(match[0])+err.Offset()+2, err.Length())
+				if isFullInterpolation(template.(string), matches) {
 					return
 				}
 			}
 		}
 	}
 
-	if len(matches) == 1 && matches[0][0] == 0 && matches[0][1] == len(template.(string)) {
+	if isFullInterpolation(template.(string), matches) {
 		// This is a single value string template that can return any type.
 		t := template.(string)
 		out, err := mexpr.Eval(t[2:len(t)-1], paramsExample)
 		if err != nil {
-			ctx.AddErrorOffset(fmt.Errorf("error validating template: unable to eval expression '%s': %v", t[2:len(t)-1], err), err.Offset()+2, err.Length())
+			ctx.AddErrorOffset(ErrExprEval.errorf("error validating template: unable to eval expression '%s': %v", t[2:len(t)-1], err), err.Offset()+2, err.Length())
+			return
+		}
+		if out == nil || allowsAny(s) {
 			return
 		}
 		outJSONType := getJSONType(out)
@@ -165,13 +202,13 @@ func validateString(ctx *context, s *jsonschema.Schema, template interface{}, pa
 				// correctly in the output.
 				return
 			}
-			ctx.AddError(fmt.Errorf("error validating template: expression '%s' results in %s but expecting %s", t[2:len(t)-1], outJSONType, strings.Join(s.Types, " or ")))
+			ctx.AddError(ErrTypeMismatch.errorf("error validating template: expression '%s' results in %s but expecting %s", t[2:len(t)-1], outJSONType, strings.Join(s.Types, " or ")))
 		}
 		return
 	}
 
 	// This will result in a string as output.
-	if !hasType(s, "string") {
+	if !allowsAny(s) && !hasType(s, "string") {
 		wrongTypeError(ctx, "string", s)
 	}
 }
@@ -179,16 +216,16 @@ func validateString(ctx *context, s *jsonschema.Schema, template interface{}, pa
 func validateBranch(ctx *context, s *jsonschema.Schema, t map[string]interface{}, paramsExample map[string]interface{}) {
 	if s, ok := t["$if"].(string); ok {
 		if !strings.HasPrefix(s, "${") {
-			ctx.WithPath("$if").AddError(fmt.Errorf("error validating template: $if expression must use ${...} interpolation syntax"))
+			ctx.WithPath("$if").AddError(ErrInvalidOperator.errorf("error validating template: $if expression must use ${...} interpolation syntax"))
 		} else {
 			_, err := mexpr.Parse(s[2:len(s)-1], paramsExample)
 			if err != nil {
-				ctx.WithPath("$if").AddErrorOffset(fmt.Errorf("error validating template: unable to test $if expression: %v", err), err.Offset()+2, err.Length())
+				ctx.WithPath("$if").AddErrorOffset(ErrExprEval.errorf("error validating template: unable to test $if expression: %v%s", err, identifierSuggestion(s[2:len(s)-1], err, paramsExample)), err.Offset()+2, err.Length())
 			}
 		}
 	}
 	if t["$then"] == nil {
-		ctx.AddError(fmt.Errorf("error validating template:  $then clause is required for $if branching"))
+		ctx.AddError(ErrInvalidOperator.errorf("error validating template:  $then clause is required for $if branching"))
 	} else {
 		ctx.Meta.TemplateComplexity++
 		validateTemplate(ctx.WithPath("$then"), s, t["$then"], paramsExample)
@@ -199,34 +236,140 @@ func validateBranch(ctx *context, s *jsonschema.Schema, t map[string]interface{}
 	}
 }
 
+// pathExprRe matches simple expressions which are just a path to a value,
+// e.g. `foo` or `foo.bar`.
+var pathExprRe = regexp.MustCompile(`^\s*[a-zA-Z_][a-zA-Z0-9_]*(\.[a-zA-Z_][a-zA-Z0-9_]*)*\s*$`)
+
+// schemaForExpr returns the schema of the value an expression refers to if
+// the expression is a simple path into the given schema, otherwise nil.
+func schemaForExpr(s *jsonschema.Schema, expr string) *jsonschema.Schema {
+	if s == nil || !pathExprRe.MatchString(expr) {
+		return nil
+	}
+
+	for _, part := range strings.Split(strings.TrimSpace(expr), ".") {
+		for s.Ref != nil {
+			s = s.Ref
+		}
+		s = s.Properties[part]
+		if s == nil {
+			return nil
+		}
+	}
+
+	for s.Ref != nil {
+		s = s.Ref
+	}
+	return s
+}
+
+func validateSwitch(ctx *context, s *jsonschema.Schema, t map[string]interface{}, paramsExample map[string]interface{}) {
+	ctx.Meta.TemplateComplexity++
+
+	var enum []interface{}
+	if v, ok := t["$switch"].(string); ok {
+		if !strings.HasPrefix(v, "${") || !strings.HasSuffix(v, "}") {
+			ctx.WithPath("$switch").AddError(ErrInvalidOperator.errorf("error validating template: $switch expression must use ${...} interpolation syntax"))
+		} else if _, err := mexpr.Parse(v[2:len(v)-1], paramsExample); err != nil {
+			ctx.WithPath("$switch").AddErrorOffset(ErrExprEval.errorf("error validating template: unable to test $switch expression: %v%s", err, identifierSuggestion(v[2:len(v)-1], err, paramsExample)), err.Offset()+2, err.Length())
+		} else if input := schemaForExpr(ctx.Doc.inputSchema, v[2:len(v)-1]); input != nil {
+			enum = input.Enum
+		}
+	} else {
+		ctx.WithPath("$switch").AddError(ErrInvalidOperator.errorf("error validating template: $switch expression must be a string"))
+	}
+
+	cases, ok := t["$case"].(map[string]interface{})
+	if !ok {
+		ctx.AddError(ErrInvalidOperator.errorf("error validating template: $case clause is required for $switch branching and must be an object"))
+		return
+	}
+
+	for _, k := range sortedKeys(cases) {
+		validateTemplate(ctx.WithPath("$case").WithPath(k), s, cases[k], paramsExample)
+	}
+
+	if t["$default"] != nil {
+		validateTemplate(ctx.WithPath("$default"), s, t["$default"], paramsExample)
+	}
+
+	if len(enum) == 0 {
+		return
+	}
+
+	// Use the input schema's enum to find cases which are missing or can never
+	// be matched.
+	allowed := map[string]bool{}
+	allowedKeys := []string{}
+	for _, value := range enum {
+		key := switchCase(value)
+		allowed[key] = true
+		allowedKeys = append(allowedKeys, key)
+	}
+
+	for _, k := range sortedKeys(cases) {
+		if !allowed[k] {
+			ctx.WithPath("$case").WithPath(k).AddWarning(ErrUnreachableCase.errorf("$case %s can never match, expecting one of %v", k, allowedKeys))
+		}
+	}
+
+	if t["$default"] == nil {
+		missing := []string{}
+		for _, k := range allowedKeys {
+			if _, ok := cases[k]; !ok {
+				missing = append(missing, k)
+			}
+		}
+		if len(missing) > 0 {
+			ctx.WithPath("$switch").AddWarning(ErrUnhandledCase.errorf("$switch does not handle %v and has no $default", missing))
+		}
+	}
+}
+
 func validateLoop(ctx *context, s *jsonschema.Schema, t map[string]interface{}, paramsExample map[string]interface{}) {
 	var item interface{}
+	isObject := false
 	switch v := t["$for"].(type) {
 	case string:
 		ctx.Meta.TemplateComplexity++
 		if !strings.HasPrefix(v, "${") {
-			ctx.WithPath("$for").AddError(fmt.Errorf("error validating template: $for expression must use ${...} interpolation syntax"))
+			ctx.WithPath("$for").AddError(ErrInvalidOperator.errorf("error validating template: $for expression must use ${...} interpolation syntax"))
 		} else {
 			results, err := mexpr.Eval(v[2:len(v)-1], paramsExample)
 			if err != nil {
-				ctx.WithPath("$for").AddErrorOffset(fmt.Errorf("error validating template: unable to test $for expression: %v", err), err.Offset()+2, err.Length())
+				ctx.WithPath("$for").AddErrorOffset(ErrExprEval.errorf("error validating template: unable to test $for expression: %v", err), err.Offset()+2, err.Length())
 				return
 			} else {
 				if a, ok := results.([]interface{}); ok {
-					item = a[0]
+					if len(a) > 0 {
+						item = a[0]
+					}
+				} else if m, ok := results.(map[string]interface{}); ok {
+					isObject = true
+					item = exampleEntry(m)
+					if len(m) == 0 {
+						if example, ok := additionalExample(ctx, v[2:len(v)-1]); ok {
+							item = map[string]interface{}{"key": "string", "value": example}
+						}
+					}
 				} else {
-					ctx.WithPath("$for").AddError((fmt.Errorf("error validating template: $for expresssion must result in an array but found '%v'", results)))
+					ctx.WithPath("$for").AddError((ErrNotIterable.errorf("error validating template: $for expresssion must result in an array or object but found '%v'", results)))
 				}
 			}
 		}
 	case []interface{}:
-		item = v[0]
+		if len(v) > 0 {
+			item = v[0]
+		}
+	case map[string]interface{}:
+		isObject = true
+		item = exampleEntry(v)
 	default:
-		ctx.WithPath("$for").AddError(fmt.Errorf("error validating template: $for expression must be an array or string"))
+		ctx.WithPath("$for").AddError(ErrInvalidOperator.errorf("error validating template: $for expression must be an array, object, or string"))
 	}
 
 	if t["$each"] == nil {
-		ctx.AddError(fmt.Errorf("error validating template: $each clause is required for $for looping"))
+		ctx.AddError(ErrInvalidOperator.errorf("error validating template: $each clause is required for $for looping"))
 	} else {
 		ctx.Meta.TemplateComplexity++
 		paramsCopy := map[string]interface{}{}
@@ -234,32 +377,186 @@ func validateLoop(ctx *context, s *jsonschema.Schema, t map[string]interface{},
 			paramsCopy[k] = v
 		}
 
-		as := "item"
 		if t["$as"] != nil {
-			if s, ok := t["$as"].(string); ok {
-				as = s
-			} else {
-				ctx.WithPath("$as").AddError(fmt.Errorf("error validating template: $as must be a string"))
+			if _, ok := t["$as"].(string); !ok && !isLoopPair(t["$as"]) {
+				ctx.WithPath("$as").AddError(ErrInvalidOperator.errorf("error validating template: $as must be a string or a pair of strings"))
+				return
+			}
+			if isLoopPair(t["$as"]) && !isObject {
+				ctx.WithPath("$as").AddError(ErrInvalidOperator.errorf("error validating template: $as pair can only be used when looping over an object"))
 				return
 			}
 		}
 
-		paramsCopy[as] = item
+		vars := newLoopVars(t["$as"])
+		vars.bind(paramsCopy, item)
 
-		loop := "loop"
-		if as != "item" {
-			loop += "_" + as
-		}
-		paramsCopy[loop] = map[string]interface{}{
+		validateLoopFilters(ctx, t, paramsCopy)
+
+		paramsCopy[vars.loop] = map[string]interface{}{
 			"index": 0,
 			"first": true,
 			"last":  false,
 		}
 
+		// Loop variables are always set, so shadowed optional params can't
+		// cause required properties to go missing.
+		bound := map[string]interface{}{vars.item: nil, vars.loop: nil}
+		if vars.key != "" {
+			bound[vars.key] = nil
+		}
+		ctx = withVars(ctx, bound, nil)
+
+		if t["$key"] != nil {
+			// Keyed loops produce an object rather than an array.
+			if !allowsAny(s) && !hasType(s, "object") {
+				wrongTypeError(ctx, "object", s)
+				return
+			}
+			validateTemplate(ctx.WithPath("$key"), &jsonschema.Schema{Types: []string{"string"}}, t["$key"], paramsCopy)
+			validateAny(ctx.WithPath("$each"), getValueSchemas(s), t["$each"], paramsCopy)
+			return
+		}
+
 		validateTemplate(ctx.WithPath("$each"), getItems(s), t["$each"], paramsCopy)
 	}
 }
 
+// exampleEntry returns an example `{key, value}` loop item for an object,
+// using the first property in sorted order as the example.
+func exampleEntry(m map[string]interface{}) map[string]interface{} {
+	entry := map[string]interface{}{"key": "string", "value": nil}
+	if keys := sortedKeys(m); len(keys) > 0 {
+		entry["key"] = keys[0]
+		entry["value"] = m[keys[0]]
+	}
+	return entry
+}
+
+// getValueSchemas returns the schemas that a value with an arbitrary key in
+// an object may need to match, i.e. its pattern and additional properties.
+// If no additional properties are allowed, then the named property schemas
+// are returned instead.
+func getValueSchemas(s *jsonschema.Schema) []*jsonschema.Schema {
+	schemas := []*jsonschema.Schema{}
+
+	patterns := make([]string, 0, len(s.PatternProperties))
+	byPattern := map[string]*jsonschema.Schema{}
+	for re, schema := range s.PatternProperties {
+		patterns = append(patterns, re.String())
+		byPattern[re.String()] = schema
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		schemas = append(schemas, byPattern[pattern])
+	}
+
+	switch addl := s.AdditionalProperties.(type) {
+	case *jsonschema.Schema:
+		schemas = append(schemas, addl)
+	case bool:
+		if !addl {
+			if len(schemas) == 0 {
+				props := getKeys(s.Properties)
+				sort.Strings(props)
+				for _, k := range props {
+					schemas = append(schemas, s.Properties[k])
+				}
+			}
+			break
+		}
+		schemas = append(schemas, &jsonschema.Schema{})
+	default:
+		schemas = append(schemas, &jsonschema.Schema{})
+	}
+
+	return schemas
+}
+
+// validateAny validates the template against each schema in turn, succeeding
+// if any of them match. If none match, the errors from the first schema are
+// reported.
+func validateAny(ctx *context, schemas []*jsonschema.Schema, template interface{}, paramsExample map[string]interface{}) {
+	if len(schemas) == 0 {
+		ctx.AddError(ErrUnknownProperty.errorf("error validating template: no properties are allowed"))
+		return
+	}
+
+	if len(schemas) > 1 {
+		for _, schema := range schemas {
+			scratch := *ctx
+			scratch.Meta = &contextMeta{}
+			validateTemplate(&scratch, schema, template, paramsExample)
+			if len(scratch.Meta.Errors) == 0 {
+				validateTemplate(ctx, schema, template, paramsExample)
+				return
+			}
+		}
+	}
+
+	validateTemplate(ctx, schemas[0], template, paramsExample)
+}
+
+// validateLoopFilters checks the optional `$where`, `$sortBy`, `$reverse`, and
+// `$limit` clauses of a `$for` loop using the example item.
+func validateLoopFilters(ctx *context, t map[string]interface{}, paramsExample map[string]interface{}) {
+	if t["$where"] != nil {
+		ctx.Meta.TemplateComplexity++
+		validateLoopExpr(ctx.WithPath("$where"), "$where", t["$where"], paramsExample)
+	}
+
+	if t["$sortBy"] != nil {
+		if result, ok := validateLoopExpr(ctx.WithPath("$sortBy"), "$sortBy", t["$sortBy"], paramsExample); ok {
+			if _, ok := sortKeyRank(result); !ok {
+				ctx.WithPath("$sortBy").AddError(ErrTypeMismatch.errorf("error validating template: $sortBy expression must result in a number, string, or boolean but found '%v'", result))
+			}
+		}
+	}
+
+	if t["$reverse"] != nil {
+		switch r := t["$reverse"].(type) {
+		case bool:
+		case string:
+			validateLoopExpr(ctx.WithPath("$reverse"), "$reverse", r, paramsExample)
+		default:
+			ctx.WithPath("$reverse").AddError(ErrInvalidOperator.errorf("error validating template: $reverse must be a boolean or expression"))
+		}
+	}
+
+	if t["$limit"] != nil {
+		switch l := t["$limit"].(type) {
+		case string:
+			if result, ok := validateLoopExpr(ctx.WithPath("$limit"), "$limit", l, paramsExample); ok {
+				if _, ok := toFloat(result); !ok {
+					ctx.WithPath("$limit").AddError(ErrTypeMismatch.errorf("error validating template: $limit expression must result in a number but found '%v'", result))
+				}
+			}
+		default:
+			if n, ok := toInt(l); !ok || n < 0 {
+				ctx.WithPath("$limit").AddError(ErrInvalidOperator.errorf("error validating template: $limit must be a non-negative integer or expression"))
+			}
+		}
+	}
+}
+
+// validateLoopExpr checks that a loop clause is a single `${...}` expression
+// and returns its result given the example params.
+func validateLoopExpr(ctx *context, name string, v interface{}, paramsExample map[string]interface{}) (interface{}, bool) {
+	expr, ok := v.(string)
+	if !ok || !strings.HasPrefix(expr, "${") || !strings.HasSuffix(expr, "}") {
+		ctx.AddError(ErrInvalidOperator.errorf("error validating template: %s expression must use ${...} interpolation syntax", name))
+		return nil, false
+	}
+
+	result, err := mexpr.Eval(expr[2:len(expr)-1], paramsExample)
+	if err != nil {
+		ctx.AddErrorOffset(ErrExprEval.errorf("error validating template: unable to test %s expression: %v", name, err), err.Offset()+2, err.Length())
+		return nil, false
+	}
+
+	return result, true
+}
+
 func validateFlatten(ctx *context, s *jsonschema.Schema, t map[string]interface{}, paramsExample map[string]interface{}) {
 	ctx.Meta.TemplateComplexity++
 	switch flat := t["$flatten"].(type) {
@@ -267,7 +564,6 @@ func validateFlatten(ctx *context, s *jsonschema.Schema, t map[string]interface{
 		for i, item := range flat {
 			validateTemplate(ctx.WithPath(fmt.Sprintf("$flatten/%d", i)), s, item, paramsExample)
 		}
-		// TODO: disallow extra properties?
 		return
 	case map[string]interface{}:
 		if flat["$for"] != nil {
@@ -281,7 +577,322 @@ func validateFlatten(ctx *context, s *jsonschema.Schema, t map[string]interface{
 			return
 		}
 	}
-	ctx.WithPath("$flatten").AddError(fmt.Errorf("$flatten must be an array or contain a $for clause"))
+	ctx.WithPath("$flatten").AddError(ErrInvalidOperator.errorf("$flatten must be an array or contain a $for clause"))
+}
+
+func validateMerge(ctx *context, s *jsonschema.Schema, t map[string]interface{}, paramsExample map[string]interface{}) {
+	ctx.Meta.TemplateComplexity++
+	switch parts := t["$merge"].(type) {
+	case []interface{}:
+		// Each part is checked against the output schema, so the properties
+		// from every part are valid in the merged result.
+		for i, item := range parts {
+			validateTemplate(ctx.WithPath(fmt.Sprintf("$merge/%d", i)), withoutRequired(s), item, paramsExample)
+		}
+		validateMergeRequired(ctx, s, parts)
+		return
+	case map[string]interface{}:
+		if parts["$for"] != nil {
+			// The loop renders a list of objects to merge, so validate each item
+			// against the schema by wrapping it in an array.
+			wrapped := &jsonschema.Schema{
+				Types: []string{"array"},
+				Items: withoutRequired(s),
+			}
+			validateTemplate(ctx.WithPath("$merge"), wrapped, parts, paramsExample)
+			return
+		}
+	}
+	ctx.WithPath("$merge").AddError(ErrInvalidOperator.errorf("$merge must be an array or contain a $for clause"))
+}
+
+// validateMergeRequired checks that the properties required by the schema are
+// output by at least one of the static objects being merged. Parts which are
+// expressions or operators could output anything, so aren't checked.
+func validateMergeRequired(ctx *context, s *jsonschema.Schema, parts []interface{}) {
+	for s.Ref != nil {
+		s = s.Ref
+	}
+	if len(s.Required) == 0 {
+		return
+	}
+
+	merged := map[string]interface{}{}
+	owners := map[string]int{}
+	for i, part := range parts {
+		m, ok := part.(map[string]interface{})
+		if !ok {
+			return
+		}
+		if op, _ := findOperator(m); op != "" {
+			return
+		}
+		for k, v := range m {
+			if prev, ok := merged[k]; ok && missingReason(ctx, newMissingScope(ctx), prev) == "" {
+				// Later parts which render nothing leave the value as-is.
+				continue
+			}
+			merged[k] = v
+			owners[k] = i
+		}
+	}
+
+	validateRequired(ctx, s, merged, func(key string) *context {
+		return ctx.WithPath(fmt.Sprintf("$merge/%d", owners[key])).WithPath(key)
+	})
+}
+
+// validateLiteral checks a `$literal` value, which is output as-is without
+// any interpolation, directly against the schema.
+func validateLiteral(ctx *context, s *jsonschema.Schema, value interface{}) {
+	if err := s.Validate(value); err != nil {
+		ctx.AddError(ErrSchemaMismatch.errorf("error validating template: $literal value is invalid: %v", err))
+	}
+}
+
+// validateSpread checks that the `$spread` value of an object results in
+// an object whose properties are allowed by the object's schema.
+func validateSpread(ctx *context, s *jsonschema.Schema, template interface{}, paramsExample map[string]interface{}) {
+	ctx.Meta.TemplateComplexity++
+
+	switch t := template.(type) {
+	case []interface{}:
+		for i, item := range t {
+			validateSpread(ctx.WithPath(i), s, item, paramsExample)
+		}
+		return
+	case map[string]interface{}:
+		// Static objects and operators are validated like any other property
+		// value of the object, though they may only provide some of the
+		// required properties.
+		validateTemplate(ctx, withoutRequired(s), t, paramsExample)
+		return
+	case string:
+		validateString(ctx, &jsonschema.Schema{Types: []string{"object"}}, t, paramsExample)
+	default:
+		ctx.AddError(ErrInvalidOperator.errorf("error validating template: $spread must be an object, array, or expression"))
+		return
+	}
+
+	// Check the properties of the example result against the schema.
+	expr := template.(string)
+	if !strings.HasPrefix(expr, "${") || !strings.HasSuffix(expr, "}") {
+		return
+	}
+	result, err := mexpr.Eval(expr[2:len(expr)-1], paramsExample)
+	if err != nil {
+		return
+	}
+	m, ok := result.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	if len(m) == 0 {
+		// Property names described by `additionalProperties` aren't known ahead
+		// of time, so check an example value against any property instead.
+		if example, ok := additionalExample(ctx, expr[2:len(expr)-1]); ok {
+			validateSpreadProperty(ctx, s, "", example)
+		}
+		return
+	}
+
+	for _, k := range sortedKeys(m) {
+		if !validateSpreadProperty(ctx, s, k, m[k]) {
+			return
+		}
+	}
+}
+
+// validateSpreadProperty checks a property added by `$spread` against the
+// object schema. An empty name checks a property whose name is not known.
+// Returns false if no further properties should be checked.
+func validateSpreadProperty(ctx *context, s *jsonschema.Schema, name string, value interface{}) bool {
+	propSchema := s.Properties[name]
+	if propSchema == nil {
+		if addl, ok := s.AdditionalProperties.(*jsonschema.Schema); ok {
+			propSchema = addl
+		} else if addl, ok := s.AdditionalProperties.(bool); ok && !addl {
+			ctx.AddError(ErrUnknownProperty.errorf("error validating template: $spread may add properties not in allowed set %v", getKeys(s.Properties)))
+			return false
+		} else {
+			return true
+		}
+	}
+
+	if value == nil || allowsAny(propSchema) {
+		return true
+	}
+	valueType := getJSONType(value)
+	if !hasType(propSchema, valueType) && !(valueType == "number" && hasType(propSchema, "integer")) {
+		label := "additional property"
+		if name != "" {
+			label = fmt.Sprintf("property '%s'", name)
+		}
+		ctx.AddError(ErrTypeMismatch.errorf("error validating template: $spread %s results in %s but expecting %s", label, valueType, strings.Join(propSchema.Types, " or ")))
+	}
+	return true
+}
+
+// additionalExample returns an example value for the properties of an input
+// object described by its `additionalProperties` schema, given an expression
+// which refers to the object. Examples generated from the input schema don't
+// include these properties as their names are not known ahead of time.
+func additionalExample(ctx *context, expr string) (interface{}, bool) {
+	s := schemaForExpr(ctx.Doc.inputSchema, expr)
+	if s == nil {
+		return nil, false
+	}
+	addl, ok := s.AdditionalProperties.(*jsonschema.Schema)
+	if !ok {
+		return nil, false
+	}
+	example, err := generateExample(addl)
+	if err != nil {
+		return nil, false
+	}
+	return example, true
+}
+
+func validateLet(ctx *context, s *jsonschema.Schema, t map[string]interface{}, paramsExample map[string]interface{}) {
+	bindings, ok := t["$let"].(map[string]interface{})
+	if !ok {
+		ctx.WithPath("$let").AddError(ErrInvalidOperator.errorf("error validating template: $let must be an object"))
+		return
+	}
+
+	if t["$in"] == nil {
+		ctx.AddError(ErrInvalidOperator.errorf("error validating template: $in clause is required for $let"))
+		return
+	}
+
+	ctx.Meta.TemplateComplexity++
+
+	// Infer the type of each binding by rendering it with the example params
+	// so that expressions using it within `$in` can be type checked.
+	paramsCopy := map[string]interface{}{}
+	for k, v := range paramsExample {
+		paramsCopy[k] = v
+	}
+	for name, value := range bindings {
+		bindingCtx := ctx.WithPath("$let").WithPath(name)
+		validateTemplate(bindingCtx, &jsonschema.Schema{}, value, paramsExample)
+		paramsCopy[name] = renderExample(bindingCtx, value, paramsExample)
+	}
+
+	validateTemplate(withVars(ctx, bindings, nil).WithPath("$in"), s, t["$in"], paramsCopy)
+}
+
+func validateRef(ctx *context, s *jsonschema.Schema, t map[string]interface{}, paramsExample map[string]interface{}) {
+	name, _ := refName(t["$ref"])
+
+	def, ok := ctx.Doc.getDefinition(name)
+	if !ok {
+		ctx.WithPath("$ref").AddError(ErrDefinitionNotFound.errorf("error validating template: definition %s not found", name))
+		return
+	}
+
+	if ctx.HasRef(name) {
+		// This is a recursive definition which is already being validated.
+		return
+	}
+
+	validateTemplate(ctx.WithRef(def), s, def.Template, paramsExample)
+}
+
+func validateCall(ctx *context, s *jsonschema.Schema, t map[string]interface{}, paramsExample map[string]interface{}) {
+	name, ok := t["$call"].(string)
+	if !ok {
+		ctx.WithPath("$call").AddError(ErrInvalidOperator.errorf("error validating template: $call must be a definition name"))
+		return
+	}
+
+	def, ok := ctx.Doc.getDefinition(name)
+	if !ok {
+		ctx.WithPath("$call").AddError(ErrDefinitionNotFound.errorf("error validating template: definition %s not found", name))
+		return
+	}
+
+	ctx.Meta.TemplateComplexity++
+
+	with := map[string]interface{}{}
+	if t["$with"] != nil {
+		if m, ok := t["$with"].(map[string]interface{}); ok {
+			with = m
+		} else {
+			ctx.WithPath("$with").AddError(ErrInvalidOperator.errorf("error validating template: $with must be an object"))
+			return
+		}
+	}
+
+	var args interface{}
+	if def.Schema != nil {
+		// Check the arguments against the declared input schema, then use an
+		// example generated from that schema to check the definition itself.
+		argSchema := def.Schema
+		for argSchema.Ref != nil {
+			argSchema = argSchema.Ref
+		}
+		validateTemplate(ctx.WithPath("$with"), withoutRequired(argSchema), with, paramsExample)
+		for _, required := range argSchema.Required {
+			if _, ok := with[required]; !ok {
+				ctx.WithPath("$with").AddError(ErrInvalidArguments.errorf("error validating template: missing required argument %s for %s", required, name))
+			}
+		}
+
+		example, err := generateExample(argSchema)
+		if err != nil {
+			ctx.WithPath("$call").AddError(ErrInvalidArguments.errorf("error validating template: unable to generate example arguments for %s: %w", name, err))
+			return
+		}
+		args = example
+	} else {
+		// No schema, so infer the argument types from the passed values.
+		validateTemplate(ctx.WithPath("$with"), &jsonschema.Schema{}, with, paramsExample)
+		args = renderExample(ctx.WithPath("$with"), with, paramsExample)
+	}
+
+	if ctx.HasRef(name) {
+		// This is a recursive definition which is already being validated.
+		return
+	}
+
+	paramsCopy := map[string]interface{}{}
+	for k, v := range paramsExample {
+		paramsCopy[k] = v
+	}
+	bound := map[string]interface{}{}
+	if m, ok := args.(map[string]interface{}); ok {
+		for k, v := range m {
+			paramsCopy[k] = v
+			bound[k] = nil
+		}
+	}
+
+	// Arguments depend on each caller, so are assumed to be passed.
+	validateTemplate(withVars(ctx, bound, def.Schema).WithRef(def), s, def.Template, paramsCopy)
+}
+
+func validateInclude(ctx *context, s *jsonschema.Schema, t map[string]interface{}, paramsExample map[string]interface{}) {
+	filename, ok := t["$include"].(string)
+	if !ok {
+		ctx.WithPath("$include").AddError(ErrInvalidOperator.errorf("error validating template: $include must be a filename"))
+		return
+	}
+
+	included, err := ctx.Doc.loadInclude(filename)
+	if err != nil {
+		ctx.WithPath("$include").AddError(ErrInclude.errorf("error validating template: unable to include %s: %w", filename, err))
+		return
+	}
+
+	if cycle := ctx.IncludeCycle(included); cycle != nil {
+		ctx.WithPath("$include").AddError(ErrIncludeCycle.errorf("error validating template: include cycle detected: %s", strings.Join(cycle, " -> ")))
+		return
+	}
+
+	ctx.Meta.TemplateComplexity++
+	validateTemplate(ctx.WithInclude(included), s, included.Template, paramsExample)
 }
 
 func validateOf(ctx *context, jsonType string, of string, schemas []*jsonschema.Schema, template interface{}, paramsExample map[string]interface{}) {
@@ -289,6 +900,7 @@ func validateOf(ctx *context, jsonType string, of string, schemas []*jsonschema.
 	// All: every single one
 	// One: exactly one
 	matches := 0
+schemas:
 	for _, s := range schemas {
 		if s.Ref != nil {
 			s = s.Ref
@@ -304,14 +916,18 @@ func validateOf(ctx *context, jsonType string, of string, schemas []*jsonschema.
 				}
 			}
 			if jsonType == "object" {
-				for k, v := range template.(map[string]interface{}) {
-					propType := getJSONType(v)
-					if s.Properties[k] != nil && !hasType(s.Properties[k], propType) {
+				t := template.(map[string]interface{})
+				for k, v := range t {
+					if !staticTypeMatches(s.Properties[k], v) {
 						// If the property exists but the type doesn't match, then this
 						// is no match and we keep going with the next schema.
-						continue
+						continue schemas
 					}
 				}
+				if of != "allOf" && !hasRequired(s, t) {
+					// Properties required by another schema may be the ones present.
+					continue
+				}
 			}
 			matches++
 			validateTemplate(ctx, s, template, paramsExample)
@@ -324,12 +940,169 @@ func validateOf(ctx *context, jsonType string, of string, schemas []*jsonschema.
 	}
 
 	if matches == 0 {
-		ctx.AddError(fmt.Errorf("error validating template: no match for %s", of))
+		ctx.AddError(ErrSchemaMismatch.errorf("error validating template: no match for %s", of))
 	} else if of == "allOf" && matches < len(schemas) {
-		ctx.AddError(fmt.Errorf("error validating template: allOf only matches %d of %d schemas", matches, len(schemas)))
+		ctx.AddError(ErrSchemaMismatch.errorf("error validating template: allOf only matches %d of %d schemas", matches, len(schemas)))
 	}
 }
 
+// staticTypeMatches returns whether a template value may match the schema.
+// Only values which are output as-is are checked, since expressions and
+// operators can result in any type.
+func staticTypeMatches(s *jsonschema.Schema, v interface{}) bool {
+	if s == nil || allowsAny(s) {
+		return true
+	}
+	switch t := v.(type) {
+	case string:
+		if matches, err := findInterpolations(t); err != nil || len(matches) > 0 {
+			return true
+		}
+	case map[string]interface{}:
+		if op, _ := findOperator(t); op != "" {
+			return true
+		}
+	}
+	valueType := getJSONType(v)
+	return hasType(s, valueType) || (valueType == "number" && hasType(s, "integer"))
+}
+
+// templateKey returns the template object key which outputs a property,
+// escaping names like `$if` which would otherwise be operators.
+func templateKey(name string) string {
+	if strings.HasPrefix(name, "$") {
+		return "$" + name
+	}
+	return name
+}
+
+// hasRequired returns whether a plain object template has each of the
+// properties required by the schema. Templates which use operators or
+// `$spread` may produce any properties, so always have them.
+func hasRequired(s *jsonschema.Schema, t map[string]interface{}) bool {
+	if op, _ := findOperator(t); op != "" {
+		return true
+	}
+	if _, ok := t["$spread"]; ok {
+		return true
+	}
+	for _, name := range s.Required {
+		if _, ok := t[templateKey(name)]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// renderExample renders a template fragment with example params in order to
+// infer the shape of its output for type checking. Errors are ignored here as
+// validation reports them separately.
+func renderExample(ctx *context, template interface{}, paramsExample map[string]interface{}) interface{} {
+	scratch := *ctx
+	scratch.Meta = &contextMeta{}
+	return render(&scratch, template, paramsExample)
+}
+
+// operatorClauses lists the keys which may be used alongside each operator,
+// in the order operators are checked when rendering. Any other keys in the
+// same object would be ignored when rendering.
+var operatorClauses = []struct {
+	name    string
+	clauses []string
+}{
+	{"$literal", nil},
+	{"$if", []string{"$then", "$else"}},
+	{"$switch", []string{"$case", "$default"}},
+	{"$for", []string{"$each", "$as", "$key", "$where", "$sortBy", "$reverse", "$limit"}},
+	{"$flatten", nil},
+	{"$merge", nil},
+	{"$let", []string{"$in"}},
+	{"$ref", nil},
+	{"$call", []string{"$with"}},
+	{"$include", nil},
+}
+
+// isOperatorKey returns whether an object key is a special `$` key rather
+// than a property, which can be output by escaping it as `$$`. Keys set by an
+// expression like `${name}` are properties.
+func isOperatorKey(k string) bool {
+	return strings.HasPrefix(k, "$") && !strings.HasPrefix(k, "$$") && !strings.HasPrefix(k, "${")
+}
+
+// findOperator returns the operator which is used to render an object along
+// with the clauses allowed alongside it, or an empty string for plain objects.
+func findOperator(t map[string]interface{}) (string, []string) {
+	for _, op := range operatorClauses {
+		v, ok := t[op.name]
+		switch op.name {
+		case "$literal":
+			// Always used, even with a null value.
+		case "$ref":
+			_, ok = refName(v)
+		default:
+			ok = v != nil
+		}
+		if ok {
+			return op.name, op.clauses
+		}
+	}
+	return "", nil
+}
+
+// validateOperatorKeys checks that each `$` key in an object is a known
+// operator or clause, and that operators are not mixed with other keys, which
+// would otherwise be silently ignored when rendering.
+func validateOperatorKeys(ctx *context, t map[string]interface{}) {
+	op, clauses := findOperator(t)
+	allowed := append([]string{op}, clauses...)
+
+	for _, k := range sortedKeys(t) {
+		if op != "" {
+			if contains(allowed, k) {
+				continue
+			}
+			if isOperatorKey(k) {
+				ctx.WithPath(k).AddError(ErrInvalidOperator.errorf("error validating template: %s cannot be used with %s%s", k, op, didYouMean(k, allowed)))
+			} else {
+				ctx.WithPath(k).AddError(ErrInvalidOperator.errorf("error validating template: property %s cannot be used with %s", unescapeKey(k), op))
+			}
+			continue
+		}
+
+		if !isOperatorKey(k) || k == "$spread" || k == "$ref" {
+			// A `$ref` which isn't a definition is output as-is.
+			continue
+		}
+
+		if owner := clauseOwner(k); owner != "" {
+			ctx.WithPath(k).AddError(ErrInvalidOperator.errorf("error validating template: %s can only be used with %s", k, owner))
+			continue
+		}
+
+		ctx.WithPath(k).AddError(ErrInvalidOperator.errorf("error validating template: unknown operator %s%s", k, didYouMean(k, operatorNames)))
+	}
+}
+
+// clauseOwner returns the operator which a clause like `$then` belongs to, or
+// an empty string if the key is not a clause.
+func clauseOwner(k string) string {
+	for _, op := range operatorClauses {
+		if contains(op.clauses, k) {
+			return op.name
+		}
+	}
+	return ""
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 func validateTemplate(ctx *context, s *jsonschema.Schema, template interface{}, paramsExample map[string]interface{}) {
 	if s == nil {
 		return
@@ -366,11 +1139,23 @@ func validateTemplate(ctx *context, s *jsonschema.Schema, template interface{},
 	if jsonType == "object" {
 		t := template.(map[string]interface{})
 
+		validateOperatorKeys(ctx, t)
+
+		if literal, ok := t["$literal"]; ok {
+			validateLiteral(ctx.WithPath("$literal"), s, literal)
+			return
+		}
+
 		if t["$if"] != nil {
 			validateBranch(ctx, s, t, paramsExample)
 			return
 		}
 
+		if t["$switch"] != nil {
+			validateSwitch(ctx, s, t, paramsExample)
+			return
+		}
+
 		if t["$for"] != nil {
 			validateLoop(ctx, s, t, paramsExample)
 			return
@@ -380,6 +1165,31 @@ func validateTemplate(ctx *context, s *jsonschema.Schema, template interface{},
 			validateFlatten(ctx, s, t, paramsExample)
 			return
 		}
+
+		if t["$merge"] != nil {
+			validateMerge(ctx, s, t, paramsExample)
+			return
+		}
+
+		if t["$let"] != nil {
+			validateLet(ctx, s, t, paramsExample)
+			return
+		}
+
+		if _, ok := refName(t["$ref"]); ok {
+			validateRef(ctx, s, t, paramsExample)
+			return
+		}
+
+		if t["$call"] != nil {
+			validateCall(ctx, s, t, paramsExample)
+			return
+		}
+
+		if t["$include"] != nil {
+			validateInclude(ctx, s, t, paramsExample)
+			return
+		}
 	}
 
 	found := false
@@ -393,7 +1203,7 @@ func validateTemplate(ctx *context, s *jsonschema.Schema, template interface{},
 		}
 	}
 
-	if !found {
+	if !found && !allowsAny(s) {
 		wrongTypeError(ctx, jsonType, s)
 		return
 	}
@@ -405,7 +1215,17 @@ func validateTemplate(ctx *context, s *jsonschema.Schema, template interface{},
 		}
 	case "object":
 		for k, v := range template.(map[string]interface{}) {
-			propSchema := s.Properties[k]
+			if k == "$spread" {
+				validateSpread(ctx.WithPath(k), s, v, paramsExample)
+				continue
+			}
+
+			if isOperatorKey(k) && k != "$ref" {
+				// Unknown operators are reported by `validateOperatorKeys`.
+				continue
+			}
+
+			propSchema := s.Properties[unescapeKey(k)]
 			if propSchema == nil {
 				// Additional properties can describe props with a variable name.
 				if addl, ok := s.AdditionalProperties.(*jsonschema.Schema); ok {
@@ -414,12 +1234,305 @@ func validateTemplate(ctx *context, s *jsonschema.Schema, template interface{},
 				}
 
 				if addl, ok := s.AdditionalProperties.(bool); ok && !addl {
-					ctx.WithPath(k).AddError(fmt.Errorf("error validating template: property %s not in allowed set %v", k, getKeys(s.Properties)))
+					allowed := getKeys(s.Properties)
+					ctx.WithPath(k).AddError(ErrUnknownProperty.errorf("error validating template: property %s not in allowed set %v%s", unescapeKey(k), allowed, didYouMean(unescapeKey(k), allowed)))
 					continue
 				}
+
+				// Any value is allowed, but expressions should still be checked.
+				propSchema = &jsonschema.Schema{}
 			}
 
 			validateTemplate(ctx.WithPath(k), propSchema, v, paramsExample)
 		}
+
+		validateRequired(ctx, s, template.(map[string]interface{}), nil)
+	}
+}
+
+// validateRequired checks that the properties required by the schema are
+// always output. Properties which are missing from the template are errors,
+// while those which may render as nil and be dropped on some paths, e.g. due
+// to optional input or an `$if` without `$else`, are warnings. The keyCtx
+// returns the context of each key's value, if not within the object itself.
+func validateRequired(ctx *context, s *jsonschema.Schema, t map[string]interface{}, keyCtx func(key string) *context) {
+	if keyCtx == nil {
+		keyCtx = func(key string) *context { return ctx.WithPath(key) }
+	}
+	_, hasSpread := t["$spread"]
+	dynamicKey := interpolatedKey(t)
+	for _, name := range s.Required {
+		key := templateKey(name)
+		v, ok := t[key]
+		if !ok {
+			switch {
+			case hasSpread:
+				// Properties from a spread aren't known until render time.
+			case dynamicKey != "":
+				ctx.AddWarning(ErrMissingProperty.errorf("required property %s may be missing: it is only output if %s renders as %s", name, dynamicKey, name))
+			default:
+				ctx.AddError(ErrMissingProperty.errorf("error validating template: missing required property %s", name))
+			}
+			continue
+		}
+
+		if reason := missingReason(ctx, newMissingScope(ctx), v); reason != "" {
+			keyCtx(key).AddWarning(ErrMissingProperty.errorf("required property %s may be missing: %s", name, reason))
+		}
+	}
+}
+
+// interpolatedKey returns the first key of an object, in sorted order, whose
+// name is set by an expression like `${name}`, or an empty string if none are.
+func interpolatedKey(t map[string]interface{}) string {
+	for _, k := range sortedKeys(t) {
+		if matches, err := findInterpolations(k); err == nil && len(matches) > 0 {
+			return k
+		}
+	}
+	return ""
+}
+
+// missingScope describes where the variables used by a template come from,
+// for finding out whether the template may render as nil.
+type missingScope struct {
+	// input is the schema of the params, used by the outermost scope.
+	input *jsonschema.Schema
+
+	// vars are local variables bound by `$let` or passed to `$call`, mapped
+	// to the templates which set them.
+	vars map[string]interface{}
+
+	// args is the schema of a definition's arguments, if any. The call is
+	// the definition's name when its `$with` arguments are known, otherwise
+	// arguments are assumed to be passed.
+	args *jsonschema.Schema
+	call string
+
+	// outer is the scope which the variable templates are rendered in.
+	outer *missingScope
+}
+
+// newMissingScope returns the scope for a template being validated, including
+// any local variables. Within a definition, arguments depend on the caller so
+// are assumed to be passed.
+func newMissingScope(ctx *context) *missingScope {
+	if ctx.Vars != nil {
+		return ctx.Vars
+	}
+	scope := &missingScope{input: ctx.Doc.inputSchema}
+	if len(ctx.Refs) > 0 {
+		if def, ok := ctx.Doc.getDefinition(ctx.Refs[len(ctx.Refs)-1]); ok && def.Schema != nil {
+			scope = &missingScope{args: def.Schema, outer: scope}
+		}
+	}
+	return scope
+}
+
+// withVars returns a context where the given local variables are bound to the
+// templates which set them, shadowing the params and any outer variables. A
+// nil template means the variable is always set, like a loop item.
+func withVars(ctx *context, vars map[string]interface{}, args *jsonschema.Schema) *context {
+	inner := *ctx
+	inner.Vars = &missingScope{vars: vars, args: args, outer: newMissingScope(ctx)}
+	return &inner
+}
+
+// pathReason returns why a simple path expression like `user.name` may result
+// in nil, or an empty string if it is always set or unknown, e.g. for loop
+// variables.
+func (scope *missingScope) pathReason(ctx *context, expr string) string {
+	if !pathExprRe.MatchString(expr) {
+		return ""
+	}
+	parts := strings.Split(strings.TrimSpace(expr), ".")
+
+	for ; scope.outer != nil; scope = scope.outer {
+		if v, ok := scope.vars[parts[0]]; ok {
+			if len(parts) > 1 {
+				return ""
+			}
+			return missingReason(ctx, scope.outer, v)
+		}
+		if scope.args != nil {
+			if prop := scope.args.Properties[parts[0]]; prop != nil {
+				if scope.call == "" || hasDefault(prop) {
+					return ""
+				}
+				return fmt.Sprintf("argument `%s` is not passed to %s and has no default", parts[0], scope.call)
+			}
+		}
+	}
+
+	return optionalInputReason(scope.input, parts)
+}
+
+// inputSchema returns the input schema of the value a path expression refers
+// to, or nil if it is not a path into the input.
+func (scope *missingScope) inputSchema(expr string) *jsonschema.Schema {
+	if !pathExprRe.MatchString(expr) {
+		return nil
+	}
+	root := strings.Split(strings.TrimSpace(expr), ".")[0]
+	for ; scope.outer != nil; scope = scope.outer {
+		if _, ok := scope.vars[root]; ok {
+			return nil
+		}
+		if scope.args != nil && scope.args.Properties[root] != nil {
+			return nil
+		}
+	}
+	return schemaForExpr(scope.input, expr)
+}
+
+// missingReason returns why a template value may render as nil, which drops
+// its property from the output, or an empty string if it is always present.
+// Definitions and includes are followed.
+func missingReason(ctx *context, scope *missingScope, template interface{}) string {
+	switch t := template.(type) {
+	case string:
+		if expr, ok := fullExpr(t); ok {
+			return scope.pathReason(ctx, expr)
+		}
+	case map[string]interface{}:
+		op, _ := findOperator(t)
+		switch op {
+		case "$if":
+			if t["$else"] == nil {
+				return fmt.Sprintf("$if has no $else, so nothing is output when %v is false", t["$if"])
+			}
+			if reason := missingReason(ctx, scope, t["$then"]); reason != "" {
+				return reason
+			}
+			return missingReason(ctx, scope, t["$else"])
+		case "$switch":
+			cases, _ := t["$case"].(map[string]interface{})
+			for _, k := range sortedKeys(cases) {
+				if reason := missingReason(ctx, scope, cases[k]); reason != "" {
+					return reason
+				}
+			}
+			if t["$default"] != nil {
+				return missingReason(ctx, scope, t["$default"])
+			}
+			expr, ok := fullExpr(t["$switch"])
+			if !ok {
+				return ""
+			}
+			if reason := scope.pathReason(ctx, expr); reason != "" {
+				return reason
+			}
+			if input := scope.inputSchema(expr); input != nil && len(input.Enum) > 0 {
+				handled := true
+				for _, value := range input.Enum {
+					if _, ok := cases[switchCase(value)]; !ok {
+						handled = false
+					}
+				}
+				if handled {
+					return ""
+				}
+			}
+			return fmt.Sprintf("$switch has no $default, so nothing is output when %v matches no $case", t["$switch"])
+		case "$for":
+			// Looping over nothing outputs nothing, rather than an empty array.
+			if expr, ok := fullExpr(t["$for"]); ok {
+				return scope.pathReason(ctx, expr)
+			}
+		case "$let":
+			bindings, _ := t["$let"].(map[string]interface{})
+			return missingReason(ctx, &missingScope{vars: bindings, outer: scope}, t["$in"])
+		case "$ref":
+			name, _ := refName(t["$ref"])
+			if def, ok := ctx.Doc.getDefinition(name); ok && !ctx.HasRef(name) {
+				return missingReason(ctx.WithRef(def), scope, def.Template)
+			}
+		case "$call":
+			name, _ := t["$call"].(string)
+			def, ok := ctx.Doc.getDefinition(name)
+			if !ok || ctx.HasRef(name) {
+				return ""
+			}
+			inner := &missingScope{vars: map[string]interface{}{}, args: def.Schema, call: name, outer: scope}
+			if t["$with"] != nil {
+				if with, ok := t["$with"].(map[string]interface{}); ok {
+					inner.vars = with
+				} else {
+					inner.vars = nil
+					inner.call = ""
+				}
+			}
+			return missingReason(ctx.WithRef(def), inner, def.Template)
+		case "$include":
+			filename, _ := t["$include"].(string)
+			included, err := ctx.Doc.loadInclude(filename)
+			if err != nil || ctx.IncludeCycle(included) != nil {
+				return ""
+			}
+			return missingReason(ctx.WithInclude(included), scope, included.Template)
+		}
+	}
+	return ""
+}
+
+// fullExpr returns the expression of a template value which is a single
+// `${...}` interpolation.
+func fullExpr(template interface{}) (string, bool) {
+	s, ok := template.(string)
+	if !ok {
+		return "", false
+	}
+	matches, err := findInterpolations(s)
+	if err != nil || !isFullInterpolation(s, matches) {
+		return "", false
+	}
+	return s[2 : len(s)-1], true
+}
+
+// optionalInputReason returns why a path like `user.name` may result in nil
+// because part of it is optional in the input schema and has no default.
+// Returns an empty string otherwise, including for paths which don't refer to
+// the input.
+func optionalInputReason(s *jsonschema.Schema, parts []string) string {
+	if s == nil {
+		return ""
+	}
+
+	for i, part := range parts {
+		for s.Ref != nil {
+			s = s.Ref
+		}
+		prop := s.Properties[part]
+		if prop == nil {
+			return ""
+		}
+		if !contains(s.Required, part) && !hasDefault(prop) {
+			return fmt.Sprintf("`%s` is optional in input schema and has no default", strings.Join(parts[:i+1], "."))
+		}
+		s = prop
+	}
+	return ""
+}
+
+// hasDefault returns whether a schema has a default value which is set when
+// the value is missing from the input.
+func hasDefault(s *jsonschema.Schema) bool {
+	for s.Ref != nil {
+		if s.Default != nil {
+			return true
+		}
+		s = s.Ref
+	}
+	return s.Default != nil
+}
+
+// withoutRequired returns a copy of the schema which doesn't require any
+// properties, for validating templates which only produce part of an object.
+func withoutRequired(s *jsonschema.Schema) *jsonschema.Schema {
+	for s.Ref != nil {
+		s = s.Ref
 	}
+	partial := *s
+	partial.Required = nil
+	return &partial
 }